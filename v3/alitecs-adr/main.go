@@ -1,27 +1,220 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
 	"github.com/hashicorp/go-plugin"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/brocaar/chirpstack-network-server/v3/adr"
 )
 
+// version is the plugin version, which is set at build time with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// maxFCntGap defines the max. frame-counter difference which is considered
+// a rollover of the counter rather than a reset (MAX_FCNT_GAP of the LoRaWAN
+// 1.0 specification).
+const maxFCntGap = 16384
+
+// maxFCntReorder defines the max. frame-counter difference which is
+// considered an out-of-order uplink when the counter goes back. Larger
+// differences, or a counter which goes back to below the difference, are
+// considered a reset of the counter.
+const maxFCntReorder = 64
+
+// adjustmentReason is a machine-readable reason of an ADR decision, it is
+// logged with every decision.
+type adjustmentReason string
+
+const (
+	reasonNoChange            adjustmentReason = "NoChange"
+	reasonInsufficientHistory adjustmentReason = "InsufficientHistory"
+	reasonADRDisabled         adjustmentReason = "ADRDisabled"
+	reasonHold                adjustmentReason = "Hold"
+	reasonDRIncrease          adjustmentReason = "DRIncrease"
+	reasonDRDecrease          adjustmentReason = "DRDecrease"
+	reasonTxPowerIncrease     adjustmentReason = "TxPowerIncrease"
+	reasonTxPowerDecrease     adjustmentReason = "TxPowerDecrease"
+	reasonNbTransChange       adjustmentReason = "NbTransChange"
+	reasonCooldown            adjustmentReason = "Cooldown"
+)
+
 // Type Handler is the ADR handler.
-type Handler struct{}
+type Handler struct {
+	// mu protects config, which can be replaced during a reload while
+	// requests are being handled.
+	mu     sync.RWMutex
+	config Config
 
-// ID must return the plugin identifier.
+	// installationMarginClamped makes that the clamp of the installation
+	// margin is only logged once.
+	installationMarginClamped sync.Once
+
+	// zeroMaxTxPowerIndex makes that a max. TxPowerIndex of 0 is only logged
+	// once.
+	zeroMaxTxPowerIndex sync.Once
+
+	// devices holds the state per device, e.g. the packet-loss when
+	// Config.PktLossPerDevice is set.
+	devices deviceStore
+}
+
+// ID must return the plugin identifier, which reflects the algorithm.
 func (h *Handler) ID() (string, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.config.Algorithm == algorithmLoRa {
+		return "alitecs-adr-lora", nil
+	}
 	return "alitecs-adr", nil
 }
 
-// Name must return a human-readable name.
+// Name must return a human-readable name, which reflects the algorithm.
 func (h *Handler) Name() (string, error) {
-	return "ALITECS ADR algorithm", nil
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.config.Algorithm == algorithmLoRa {
+		return "ALITECS ADR algorithm, LoRa textbook (" + version + ")", nil
+	}
+	return "ALITECS ADR algorithm (" + version + ")", nil
+}
+
+// Version returns the plugin version. It is not part of adr.Handler, the
+// version is therefore also included in the name.
+func (h *Handler) Version() (string, error) {
+	return version, nil
 }
 
 // Handle handles the ADR request.
 func (h *Handler) Handle(req adr.HandleRequest) (adr.HandleResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return adr.HandleResponse{}, err
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	fields := log.Fields{}
+	resp, err := h.getAlgorithm().handle(req, fields)
+	if err != nil {
+		return resp, err
+	}
+
+	// The reasons why the algorithm kept the current values (set by handle),
+	// followed by the changes.
+	reasons, _ := fields["reason"].([]adjustmentReason)
+	reasons = append(reasons, getAdjustmentReasons(req, resp)...)
+	if len(reasons) == 0 {
+		reasons = []adjustmentReason{reasonNoChange}
+	}
+	fields["reason"] = reasons
+
+	log.WithFields(fields).WithFields(log.Fields{
+		"dev_eui":            req.DevEUI,
+		"dr":                 req.DR,
+		"tx_power_index":     req.TxPowerIndex,
+		"nb_trans":           req.NbTrans,
+		"new_dr":             resp.DR,
+		"new_tx_power_index": resp.TxPowerIndex,
+		"new_nb_trans":       resp.NbTrans,
+	}).Debug("ADR request handled")
+
+	// In dry-run mode, log the calculated response but return the current
+	// device state.
+	if h.config.DryRun {
+		log.WithFields(log.Fields{
+			"dev_eui":        req.DevEUI,
+			"dr":             resp.DR,
+			"tx_power_index": resp.TxPowerIndex,
+			"nb_trans":       resp.NbTrans,
+		}).Info("Dry-run, not applying the ADR response")
+
+		resp = adr.HandleResponse{
+			DR:           req.DR,
+			TxPowerIndex: req.TxPowerIndex,
+			NbTrans:      req.NbTrans,
+		}
+	}
+
+	// The metrics and the cooldown only follow the applied changes, in
+	// dry-run mode there are none.
+	recordMetrics(req, resp)
+	if len(getAdjustmentReasons(req, resp)) != 0 {
+		h.startCooldown(req)
+	}
+
+	return resp, nil
+}
+
+// getAdjustmentReasons returns the changes of the response compared to the
+// request.
+func getAdjustmentReasons(req adr.HandleRequest, resp adr.HandleResponse) []adjustmentReason {
+	var reasons []adjustmentReason
+
+	if resp.DR > req.DR {
+		reasons = append(reasons, reasonDRIncrease)
+	} else if resp.DR < req.DR {
+		reasons = append(reasons, reasonDRDecrease)
+	}
+
+	if resp.TxPowerIndex < req.TxPowerIndex {
+		reasons = append(reasons, reasonTxPowerIncrease)
+	} else if resp.TxPowerIndex > req.TxPowerIndex {
+		reasons = append(reasons, reasonTxPowerDecrease)
+	}
+
+	if resp.NbTrans != req.NbTrans {
+		reasons = append(reasons, reasonNbTransChange)
+	}
+
+	return reasons
+}
+
+// validateRequest validates the bounds of the request fields the algorithm
+// depends on. The DR and TxPowerIndex are not validated against their max.
+// values, the algorithm lowers them to the max. value.
+func validateRequest(req adr.HandleRequest) error {
+	// LoRaWAN encodes the DR, TxPower and NbTrans in 4 bits.
+	checks := []struct {
+		field    string
+		value    int
+		min, max int
+	}{
+		{"MaxDR", req.MaxDR, 0, 15},
+		{"MinDR", req.MinDR, 0, req.MaxDR},
+		{"DR", req.DR, 0, 15},
+		{"MaxTxPowerIndex", req.MaxTxPowerIndex, 0, 15},
+		{"TxPowerIndex", req.TxPowerIndex, 0, 15},
+		{"NbTrans", req.NbTrans, 1, 15},
+	}
+
+	for _, c := range checks {
+		if c.value < c.min || c.value > c.max {
+			return fmt.Errorf("invalid request: %s must be within %d - %d, got %d", c.field, c.min, c.max, c.value)
+		}
+	}
+
+	return nil
+}
+
+// handle implements the ADR algorithm. The intermediate results are added to
+// fields, for logging the decision. When the algorithm keeps the current
+// values, the reason is added as []adjustmentReason under "reason".
+func (h *Handler) handle(req adr.HandleRequest, fields log.Fields) (adr.HandleResponse, error) {
 	// This defines the default response, which is equal to the current device
 	// state.
 	resp := adr.HandleResponse{
@@ -32,41 +225,483 @@ func (h *Handler) Handle(req adr.HandleRequest) (adr.HandleResponse, error) {
 
 	// If ADR is disabled, return with current values.
 	if !req.ADR {
+		fields["reason"] = []adjustmentReason{reasonADRDisabled}
+		return resp, nil
+	}
+
+	// Without any (plausible) uplink history, e.g. during a firmware update,
+	// hold the current values without applying the limits below. adr.HandleResponse
+	// has no hold flag, but the network server only sends a LinkADRReq when
+	// the response differs from the current device state. A discarded uplink
+	// was received, the packet-loss uses the history before discarding.
+	lossReq := req
+	lossReq.UplinkHistory = h.normalizeHistory(req)
+	req.UplinkHistory = h.discardImplausible(req)
+	if len(req.UplinkHistory) == 0 {
+		fields["reason"] = []adjustmentReason{reasonHold}
 		return resp, nil
 	}
 
-	// Lower the DR only if it exceeds the max. allowed DR.
+	// All statistics below operate on the normalized history. req is a copy,
+	// this does not modify the history of the caller.
+	req.UplinkHistory = h.normalizeHistory(req)
+
+	// Lower the DR only if it exceeds the max. allowed DR and raise it only if
+	// it is below the min. allowed DR, so that the response DR is always
+	// within [MinDR, MaxDR]. The dwell-time limitation raises the min. DR.
 	if req.DR > req.MaxDR {
 		resp.DR = req.MaxDR
 	}
+	if resp.DR < req.MinDR {
+		resp.DR = req.MinDR
+	}
+	if minDR := h.getDwellTimeMinDR(req); resp.DR < minDR {
+		resp.DR = minDR
+	}
+
+	// Raise the TxPowerIndex if it is below the configured min. TxPowerIndex
+	// and lower it if it exceeds the max. allowed TxPowerIndex, e.g. after a
+	// change of the device-profile. The steps below only move the
+	// TxPowerIndex towards these limits.
+	if resp.TxPowerIndex < h.config.MinTxPowerIndex {
+		resp.TxPowerIndex = h.config.MinTxPowerIndex
+	}
+	if resp.TxPowerIndex > req.MaxTxPowerIndex {
+		resp.TxPowerIndex = req.MaxTxPowerIndex
+	}
+
+	// With a max. TxPowerIndex of 0 the TxPower can never be decreased, all
+	// positive steps go into DR increases. This is valid, but often a
+	// misconfiguration of the device-profile.
+	if req.MaxTxPowerIndex == 0 {
+		h.zeroMaxTxPowerIndex.Do(func() {
+			log.WithField("dev_eui", req.DevEUI).Warning("Max. TxPowerIndex is 0, the TxPower is never decreased")
+		})
+	}
+
+	// Give the device time to apply the previous change.
+	if h.inCooldown(req) {
+		log.WithField("dev_eui", req.DevEUI).Debug("Cooldown, keeping the current values")
+		fields["reason"] = []adjustmentReason{reasonCooldown}
+		return resp, nil
+	}
+
+	// Without enough uplink history the statistics below are meaningless, e.g.
+	// the max. SNR of an empty history is -999. Keep the current values,
+	// unless the shorter history qualifies for the quick start.
+	quickStart := false
+	if len(req.UplinkHistory) < h.requiredHistoryCount() {
+		if !h.isQuickStart(req) {
+			log.WithFields(log.Fields{
+				"dev_eui":                req.DevEUI,
+				"history_count":          len(req.UplinkHistory),
+				"required_history_count": h.requiredHistoryCount(),
+			}).Debug("Not enough uplink history, keeping the current values")
+			fields["reason"] = []adjustmentReason{reasonInsufficientHistory}
+			return resp, nil
+		}
+
+		log.WithFields(log.Fields{
+			"dev_eui":       req.DevEUI,
+			"history_count": len(req.UplinkHistory),
+		}).Debug("No lost frames, quick start")
+		quickStart = true
+	}
 
-	// Set the new NbTrans.
-	resp.NbTrans = h.getNbTrans(req.NbTrans, h.getPacketLossPercentage(req))
+	// When no uplink reports an SNR (all at the -999 sentinel), the SNR margin
+	// would be roughly -1000 dB. Keep the current values.
+	if !hasSNR(req) && !h.useRSSIFallback(req) {
+		log.WithField("dev_eui", req.DevEUI).Debug("No SNR in the uplink history, keeping the current values")
+		fields["reason"] = []adjustmentReason{reasonInsufficientHistory}
+		return resp, nil
+	}
+
+	// Set the new NbTrans. During the quick start the history is too short
+	// to calculate the packet-loss. Confirmed uplinks are already
+	// retransmitted by the device, NbTrans > 1 would only waste airtime.
+	if !h.config.DisableNbTrans && h.isConfirmedDevice(req) {
+		resp.NbTrans = 1
+	} else if !h.config.DisableNbTrans && !quickStart {
+		var pktLossRate float32
+		if h.config.PktLossPerDevice {
+			pktLossRate = h.getDevicePacketLossPercentage(lossReq)
+		} else {
+			pktLossRate = h.getPacketLossPercentage(lossReq)
+		}
+		fields["pkt_loss_rate"] = pktLossRate
+		resp.NbTrans = h.getNbTrans(req.NbTrans, pktLossRate)
+	}
 
 	// Calculate the number of 'steps'.
-	snrM := h.getMaxSNR(req)
-	snrMargin := snrM - req.RequiredSNRForDR - req.InstallationMargin
-	nStep := int(snrMargin / 3)
+	snrMargin := h.getMargin(req)
+	stepSize := h.getStepSize(req)
+	nStep := int(snrMargin / stepSize)
+
+	// Ignore the steps while the SNR margin is within the hysteresis
+	// dead-band, which can be asymmetric.
+	hysteresisUp, hysteresisDown := h.getHysteresis()
+	if (nStep > 0 && snrMargin <= hysteresisUp) || (nStep < 0 && snrMargin >= -hysteresisDown) {
+		nStep = 0
+	}
+
+	fields["snr_margin"] = snrMargin
+	fields["n_step"] = nStep
+	snrMarginHistogram.Observe(float64(snrMargin))
+	nStepHistogram.Observe(float64(nStep))
 
 	// In case of negative steps the ADR algorithm will increase the TxPower
 	// if possible. To avoid up / down / up / down TxPower changes, wait until
 	// we have at least the required number of uplink history elements.
-	if nStep < 0 && h.getHistoryCount(req) != h.requiredHistoryCount() {
+	if nStep < 0 && h.getHistoryCount(req) < h.requiredHistoryCount() {
+		fields["reason"] = []adjustmentReason{reasonInsufficientHistory}
 		return resp, nil
 	}
 
-	resp.TxPowerIndex, resp.DR = h.getIdealTxPowerIndexAndDR(nStep, resp.TxPowerIndex, resp.DR, req.MaxTxPowerIndex, req.MaxDR)
+	// Only increase the DR when the number of steps reaches the threshold and
+	// when the device is received by enough gateways.
+	increaseDR := nStep >= h.config.DRIncreaseThreshold && h.getMinGatewayCount(req) >= h.config.MinGatewayCount
+
+	nStep = h.limitSteps(nStep)
+	txPowerIndex, dr := h.getIdealTxPowerIndexAndDR(nStep, resp.TxPowerIndex, resp.DR, h.config.MinTxPowerIndex, req.MaxTxPowerIndex, h.getMinDR(req), req.MaxDR, increaseDR)
+
+	// The SNR margin contains the DR margin of the current DR. When
+	// increasing the DR, the DR margin of the target DR must be met, reduce
+	// the steps until it is.
+	for dr > resp.DR && nStep > 0 {
+		extra := h.getDRMargin(dr) - h.getDRMargin(req.DR)
+		if int((snrMargin-extra)/stepSize) >= nStep {
+			break
+		}
+
+		nStep--
+		txPowerIndex, dr = h.getIdealTxPowerIndexAndDR(nStep, resp.TxPowerIndex, resp.DR, h.config.MinTxPowerIndex, req.MaxTxPowerIndex, h.getMinDR(req), req.MaxDR, increaseDR)
+	}
+
+	resp.TxPowerIndex, resp.DR = txPowerIndex, dr
 
 	return resp, nil
 }
 
+// discardImplausible returns a copy of the uplink history without the uplinks
+// outside the plausibility bounds. The SNR range does not apply to uplinks
+// without SNR (-999).
+func (h *Handler) discardImplausible(req adr.HandleRequest) []adr.UplinkMetaData {
+	minSNR, maxSNR := h.config.PlausibleSNRMin, h.config.PlausibleSNRMax
+	if minSNR == nil && maxSNR == nil && h.config.PlausibleGatewayCountMin == 0 {
+		return req.UplinkHistory
+	}
+
+	history := make([]adr.UplinkMetaData, 0, len(req.UplinkHistory))
+	for _, m := range req.UplinkHistory {
+		if m.MaxSNR > -999 && ((minSNR != nil && m.MaxSNR < *minSNR) || (maxSNR != nil && m.MaxSNR > *maxSNR)) {
+			continue
+		}
+		if m.GatewayCount < h.config.PlausibleGatewayCountMin {
+			continue
+		}
+		history = append(history, m)
+	}
+
+	if discarded := len(req.UplinkHistory) - len(history); discarded != 0 {
+		log.WithFields(log.Fields{
+			"dev_eui":   req.DevEUI,
+			"discarded": discarded,
+		}).Debug("Discarded implausible uplinks")
+	}
+
+	return history
+}
+
+// normalizeHistory returns a copy of the uplink history, sorted by
+// frame-counter. The network server might provide the history out-of-order,
+// e.g. after a restore. Elements are only sorted within the segments between
+// frame-counter resets and rollovers of the counter are taken into account.
+// Elements sharing a frame-counter (e.g. with NbTrans > 1) are merged into a
+// single element with the max. SNR, RSSI and gateway count, so that a frame
+// does not count more than once.
+func (h *Handler) normalizeHistory(req adr.HandleRequest) []adr.UplinkMetaData {
+	type element struct {
+		segment int
+		fCnt    int64 // frame-counter relative to the start of the segment
+		m       adr.UplinkMetaData
+	}
+
+	elements := make([]element, len(req.UplinkHistory))
+	for i, m := range req.UplinkHistory {
+		elements[i].m = m
+		if i == 0 {
+			continue
+		}
+
+		prev := elements[i-1]
+		if d, ok := h.getFCntDistance(prev.m.FCnt, m.FCnt, req.MACVersion); ok {
+			elements[i].segment = prev.segment
+			elements[i].fCnt = prev.fCnt + d
+		} else {
+			elements[i].segment = prev.segment + 1
+		}
+	}
+
+	sort.SliceStable(elements, func(i, j int) bool {
+		if elements[i].segment != elements[j].segment {
+			return elements[i].segment < elements[j].segment
+		}
+		return elements[i].fCnt < elements[j].fCnt
+	})
+
+	history := make([]adr.UplinkMetaData, 0, len(elements))
+	for i, el := range elements {
+		if i == 0 || el.segment != elements[i-1].segment || el.fCnt != elements[i-1].fCnt {
+			history = append(history, el.m)
+			continue
+		}
+
+		last := &history[len(history)-1]
+		if el.m.MaxSNR > last.MaxSNR {
+			last.MaxSNR = el.m.MaxSNR
+		}
+		if el.m.MaxRSSI > last.MaxRSSI {
+			last.MaxRSSI = el.m.MaxRSSI
+		}
+		if el.m.GatewayCount > last.GatewayCount {
+			last.GatewayCount = el.m.GatewayCount
+		}
+	}
+
+	return history
+}
+
 func (h *Handler) pktLossRateTable() [][3]int {
-	return [][3]int{
-		{1, 1, 2},
-		{1, 2, 3},
-		{2, 3, 3},
-		{3, 3, 3},
+	return h.config.PktLossRateTable[:]
+}
+
+// getMargin returns the link margin (dB), which is the SNR margin or, when
+// the SNR is saturated or missing, the RSSI margin.
+func (h *Handler) getMargin(req adr.HandleRequest) float32 {
+	margins := h.getMargins(req)
+
+	// Without SNR the SNR is estimated from the RSSI relative to the noise
+	// floor.
+	if h.useRSSIFallback(req) {
+		rssiM := h.getMaxRSSI(req)
+		log.WithFields(log.Fields{
+			"dev_eui":  req.DevEUI,
+			"max_rssi": rssiM,
+		}).Warning("No SNR in the uplink history, using the RSSI fallback")
+		return rssiM - *h.config.RSSINoiseFloor - h.getRequiredSNR(req) - margins
+	}
+
+	snrM := h.getSNR(req)
+	margin := snrM - h.getRequiredSNR(req) - margins
+
+	// In strong-signal deployments the SNR saturates at the receiver ceiling
+	// and the SNR margin no longer reflects the headroom. The RSSI relative to
+	// the reference level is a better discriminator in that case. Network
+	// servers before v3.16 do not report the RSSI, then the SNR margin is
+	// used.
+	if h.config.SNRSaturation != nil && snrM >= *h.config.SNRSaturation {
+		if rssiM := h.getMaxRSSI(req); rssiM != -999 {
+			log.WithFields(log.Fields{
+				"dev_eui":  req.DevEUI,
+				"max_snr":  snrM,
+				"max_rssi": rssiM,
+			}).Debug("SNR is saturated, using the RSSI margin")
+			margin = rssiM - h.config.RSSIReference - margins
+		}
+	}
+
+	return margin
+}
+
+// getMargins returns the sum of the margins (dB) which are subtracted from the
+// SNR or RSSI margin.
+func (h *Handler) getMargins(req adr.HandleRequest) float32 {
+	return h.getInstallationMargin(req) + h.getDRMargin(req.DR) + h.getSingleGatewayMargin(req)
+}
+
+// getStepSize returns the step size (dB) of the region of the request, or
+// the StepSize for regions without step size.
+func (h *Handler) getStepSize(req adr.HandleRequest) float32 {
+	if size, ok := h.config.RegionStepSize[req.Region]; ok {
+		return size
 	}
+	return h.config.StepSize
+}
+
+// getHysteresis returns the hysteresis (dB) for positive and negative steps.
+func (h *Handler) getHysteresis() (float32, float32) {
+	up, down := h.config.HysteresisDB, h.config.HysteresisDB
+	if h.config.HysteresisUpDB != nil {
+		up = *h.config.HysteresisUpDB
+	}
+	if h.config.HysteresisDownDB != nil {
+		down = *h.config.HysteresisDownDB
+	}
+	return up, down
+}
+
+// getRequiredSNR returns the required SNR for the current DR, which is the
+// configured value or else the value of the network server.
+func (h *Handler) getRequiredSNR(req adr.HandleRequest) float32 {
+	if snr, ok := h.config.RequiredSNR[strconv.Itoa(req.DR)]; ok {
+		return snr
+	}
+	return req.RequiredSNRForDR
+}
+
+// getInstallationMargin returns the installation margin, which is the
+// configured override or else the margin of the network server, clamped to
+// the configured min. and max., plus the margin of the region.
+func (h *Handler) getInstallationMargin(req adr.HandleRequest) float32 {
+	if h.config.InstallationMarginOverride != nil {
+		return *h.config.InstallationMarginOverride
+	}
+
+	margin := req.InstallationMargin
+	if h.config.InstallationMarginMin != nil && margin < *h.config.InstallationMarginMin {
+		margin = *h.config.InstallationMarginMin
+	}
+	if h.config.InstallationMarginMax != nil && margin > *h.config.InstallationMarginMax {
+		margin = *h.config.InstallationMarginMax
+	}
+
+	if margin != req.InstallationMargin {
+		h.installationMarginClamped.Do(func() {
+			log.WithFields(log.Fields{
+				"installation_margin": req.InstallationMargin,
+				"clamped_to":          margin,
+			}).Warning("Installation margin of the network server is out of range, clamping it")
+		})
+	}
+
+	return margin + h.config.RegionInstallationMargin[req.Region]
+}
+
+// getDRMargin returns the DR margin (dB) of the given DR, 0 when it is not
+// configured.
+func (h *Handler) getDRMargin(dr int) float32 {
+	return h.config.DRMargin[strconv.Itoa(dr)]
+}
+
+// getSingleGatewayMargin returns the single-gateway margin (dB) when the
+// median gateway count of the uplink history is 1, otherwise 0.
+func (h *Handler) getSingleGatewayMargin(req adr.HandleRequest) float32 {
+	if h.config.SingleGatewayMargin == 0 || len(req.UplinkHistory) == 0 {
+		return 0
+	}
+
+	counts := make([]int, 0, len(req.UplinkHistory))
+	for _, m := range req.UplinkHistory {
+		counts = append(counts, m.GatewayCount)
+	}
+	sort.Ints(counts)
+
+	// The median of an even number of counts is 1 when both middle counts
+	// are 1.
+	n := len(counts)
+	if counts[n/2] != 1 || counts[(n-1)/2] != 1 {
+		return 0
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":               req.DevEUI,
+		"single_gateway_margin": h.config.SingleGatewayMargin,
+	}).Debug("Device is received by a single gateway, adding the single-gateway margin")
+	return h.config.SingleGatewayMargin
+}
+
+// getSNR returns the representative SNR of the uplink history, using the
+// configured strategy.
+func (h *Handler) getSNR(req adr.HandleRequest) float32 {
+	// The history is sorted by frame-counter, keep the most recent uplinks.
+	// req is a copy, this does not modify the history of the caller.
+	if n := h.config.SNRWindow; n != 0 && n < len(req.UplinkHistory) {
+		req.UplinkHistory = req.UplinkHistory[len(req.UplinkHistory)-n:]
+	}
+	req.UplinkHistory = withSNR(req.UplinkHistory)
+	req.UplinkHistory = h.discardSNROutliers(req)
+
+	switch h.config.SNRStrategy {
+	case snrStrategyMin:
+		return h.getMinSNR(req)
+	case snrStrategyMedian:
+		return h.getMedianSNR(req)
+	case snrStrategyPercentile:
+		return h.getPercentileSNR(req, h.config.SNRPercentile)
+	case snrStrategyEWMA:
+		return h.getEWMASNR(req, h.config.SNREWMAAlpha)
+	case snrStrategyMean, snrStrategyAvg:
+		return h.getMeanSNR(req)
+	case snrStrategyWeightedMean:
+		return h.getWeightedMeanSNR(req)
+	case snrStrategyTrimmedMean:
+		return h.getTrimmedMeanSNR(req, h.config.SNRTrimFraction)
+	case snrStrategyRecency:
+		return h.getRecencyWeightedSNR(req, h.config.SNRRecencyFloor)
+	default:
+		if p, ok := percentileStrategy(h.config.SNRStrategy); ok {
+			return h.getPercentileSNR(req, p)
+		}
+		return h.getMaxSNR(req)
+	}
+}
+
+// withSNR returns a copy of the uplink history without the uplinks without
+// SNR (-999), which would otherwise pull down every strategy but the max.
+func withSNR(history []adr.UplinkMetaData) []adr.UplinkMetaData {
+	filtered := make([]adr.UplinkMetaData, 0, len(history))
+	for _, m := range history {
+		if m.MaxSNR > -999 {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// discardSNROutliers returns a copy of the uplink history without the
+// uplinks whose SNR is more than snr_outlier_sigma standard deviations below
+// the mean SNR. Uplinks without SNR (-999) are kept and do not count for the
+// mean.
+func (h *Handler) discardSNROutliers(req adr.HandleRequest) []adr.UplinkMetaData {
+	sigma := h.config.SNROutlierSigma
+	if sigma == 0 {
+		return req.UplinkHistory
+	}
+
+	var n int
+	var sum, sumSq float64
+	for _, m := range req.UplinkHistory {
+		if m.MaxSNR > -999 {
+			n++
+			sum += float64(m.MaxSNR)
+			sumSq += float64(m.MaxSNR) * float64(m.MaxSNR)
+		}
+	}
+	if n < 2 {
+		return req.UplinkHistory
+	}
+
+	mean := sum / float64(n)
+	stdDev := math.Sqrt(math.Max(sumSq/float64(n)-mean*mean, 0))
+	limit := mean - sigma*stdDev
+
+	history := make([]adr.UplinkMetaData, 0, len(req.UplinkHistory))
+	for _, m := range req.UplinkHistory {
+		if m.MaxSNR > -999 && float64(m.MaxSNR) < limit {
+			continue
+		}
+		history = append(history, m)
+	}
+
+	if discarded := len(req.UplinkHistory) - len(history); discarded != 0 {
+		log.WithFields(log.Fields{
+			"dev_eui":   req.DevEUI,
+			"discarded": discarded,
+			"snr_limit": limit,
+		}).Debug("Discarded SNR outliers")
+	}
+
+	return history
 }
 
 func (h *Handler) getMaxSNR(req adr.HandleRequest) float32 {
@@ -79,6 +714,234 @@ func (h *Handler) getMaxSNR(req adr.HandleRequest) float32 {
 	return snrM
 }
 
+// getMinSNR returns the min. SNR of the uplink history, skipping the uplinks
+// without SNR (-999). Like getMaxSNR it returns -999 when no uplink reports an
+// SNR.
+func (h *Handler) getMinSNR(req adr.HandleRequest) float32 {
+	var snrM float32 = -999
+	for _, m := range req.UplinkHistory {
+		if m.MaxSNR > -999 && (snrM == -999 || m.MaxSNR < snrM) {
+			snrM = m.MaxSNR
+		}
+	}
+	return snrM
+}
+
+// getMaxRSSI returns the max. RSSI of the uplink history. It returns -999
+// when the history is empty or when the RSSI is not reported (0).
+func (h *Handler) getMaxRSSI(req adr.HandleRequest) float32 {
+	var rssiM float32 = -999
+	for _, m := range req.UplinkHistory {
+		if m.MaxRSSI != 0 && float32(m.MaxRSSI) > rssiM {
+			rssiM = float32(m.MaxRSSI)
+		}
+	}
+	return rssiM
+}
+
+// getMedianSNR returns the median SNR of the uplink history.
+func (h *Handler) getMedianSNR(req adr.HandleRequest) float32 {
+	return h.getPercentileSNR(req, 50)
+}
+
+// getPercentileSNR returns the p-th percentile (0 - 100) SNR of the uplink
+// history, interpolating linearly between the closest ranks. Like getMaxSNR
+// it returns -999 when the history is empty.
+func (h *Handler) getPercentileSNR(req adr.HandleRequest, p float64) float32 {
+	if len(req.UplinkHistory) == 0 {
+		return -999
+	}
+
+	snrs := make([]float32, 0, len(req.UplinkHistory))
+	for _, m := range req.UplinkHistory {
+		snrs = append(snrs, m.MaxSNR)
+	}
+	sort.Slice(snrs, func(i, j int) bool { return snrs[i] < snrs[j] })
+
+	rank := p / 100 * float64(len(snrs)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return snrs[lower] + (snrs[upper]-snrs[lower])*float32(rank-float64(lower))
+}
+
+// getEWMASNR returns the exponentially weighted moving average SNR of the
+// uplink history (most recent last), using the given smoothing factor. Like
+// getMaxSNR it returns -999 when the history is empty.
+func (h *Handler) getEWMASNR(req adr.HandleRequest, alpha float32) float32 {
+	if len(req.UplinkHistory) == 0 {
+		return -999
+	}
+
+	snr := req.UplinkHistory[0].MaxSNR
+	for _, m := range req.UplinkHistory[1:] {
+		snr = alpha*m.MaxSNR + (1-alpha)*snr
+	}
+
+	return snr
+}
+
+// getMeanSNR returns the mean SNR of the uplink history. Like getMaxSNR it
+// returns -999 when the history is empty.
+func (h *Handler) getMeanSNR(req adr.HandleRequest) float32 {
+	if len(req.UplinkHistory) == 0 {
+		return -999
+	}
+
+	var sum float32
+	for _, m := range req.UplinkHistory {
+		sum += m.MaxSNR
+	}
+
+	return sum / float32(len(req.UplinkHistory))
+}
+
+// getTrimmedMeanSNR returns the mean SNR of the uplink history, without the
+// given fraction of the lowest and of the highest SNRs. Like getMaxSNR it
+// returns -999 when the history is empty.
+func (h *Handler) getTrimmedMeanSNR(req adr.HandleRequest, fraction float64) float32 {
+	if len(req.UplinkHistory) == 0 {
+		return -999
+	}
+
+	snrs := make([]float32, 0, len(req.UplinkHistory))
+	for _, m := range req.UplinkHistory {
+		snrs = append(snrs, m.MaxSNR)
+	}
+	sort.Slice(snrs, func(i, j int) bool { return snrs[i] < snrs[j] })
+
+	// fraction is below 0.5, at least one SNR is left.
+	trim := int(fraction * float64(len(snrs)))
+	snrs = snrs[trim : len(snrs)-trim]
+
+	var sum float32
+	for _, snr := range snrs {
+		sum += snr
+	}
+
+	return sum / float32(len(snrs))
+}
+
+// getRecencyWeightedSNR returns the mean SNR of the uplink history (most
+// recent last), weighted linearly by age from floor for the oldest to 1 for
+// the newest uplink. Uplinks with the same frame-counter get the same weight
+// and histories with fewer than 3 uplinks use the plain mean. Like getMaxSNR
+// it returns -999 when the history is empty.
+func (h *Handler) getRecencyWeightedSNR(req adr.HandleRequest, floor float64) float32 {
+	if len(req.UplinkHistory) < 3 {
+		return h.getMeanSNR(req)
+	}
+
+	// The rank of each uplink, uplinks with the same frame-counter share
+	// their rank.
+	ranks := make([]int, len(req.UplinkHistory))
+	for i := 1; i < len(req.UplinkHistory); i++ {
+		ranks[i] = ranks[i-1]
+		if req.UplinkHistory[i].FCnt != req.UplinkHistory[i-1].FCnt {
+			ranks[i]++
+		}
+	}
+
+	last := ranks[len(ranks)-1]
+	if last == 0 {
+		return h.getMeanSNR(req)
+	}
+
+	var sum, weights float64
+	for i, m := range req.UplinkHistory {
+		w := floor + (1-floor)*float64(ranks[i])/float64(last)
+		sum += float64(m.MaxSNR) * w
+		weights += w
+	}
+
+	if weights == 0 {
+		return h.getMeanSNR(req)
+	}
+
+	return float32(sum / weights)
+}
+
+// getWeightedMeanSNR returns the mean SNR of the uplink history, weighted by
+// the gateway count of each uplink. An uplink received by multiple gateways
+// is stronger evidence of the link quality than one received by a single
+// gateway. Like getMaxSNR it returns -999 when the history is empty.
+func (h *Handler) getWeightedMeanSNR(req adr.HandleRequest) float32 {
+	var sum, weights float32
+	for _, m := range req.UplinkHistory {
+		w := h.getGatewayWeight(m.GatewayCount)
+		sum += m.MaxSNR * w
+		weights += w
+	}
+
+	if weights == 0 {
+		return h.getMeanSNR(req)
+	}
+
+	return sum / weights
+}
+
+// getGatewayWeight returns the weight of an uplink received by the given
+// number of gateways, using the configured weighting and saturation.
+func (h *Handler) getGatewayWeight(gatewayCount int) float32 {
+	if h.config.SNRGatewaySaturation != 0 && gatewayCount > h.config.SNRGatewaySaturation {
+		gatewayCount = h.config.SNRGatewaySaturation
+	}
+	if gatewayCount <= 0 {
+		return 0
+	}
+
+	switch h.config.SNRGatewayWeighting {
+	case gatewayWeightingSqrt:
+		return float32(math.Sqrt(float64(gatewayCount)))
+	case gatewayWeightingLog:
+		return float32(1 + math.Log(float64(gatewayCount)))
+	default:
+		return float32(gatewayCount)
+	}
+}
+
+// hasSNR returns true when at least one uplink of the history reports an SNR
+// above the -999 sentinel.
+func hasSNR(req adr.HandleRequest) bool {
+	for _, m := range req.UplinkHistory {
+		if m.MaxSNR > -999 {
+			return true
+		}
+	}
+	return false
+}
+
+// useRSSIFallback returns true when the RSSI fallback is enabled and the
+// uplink history reports an RSSI, but all SNRs are 0 or -999.
+func (h *Handler) useRSSIFallback(req adr.HandleRequest) bool {
+	if h.config.RSSINoiseFloor == nil {
+		return false
+	}
+
+	for _, m := range req.UplinkHistory {
+		if m.MaxSNR != 0 && m.MaxSNR > -999 {
+			return false
+		}
+	}
+
+	return h.getMaxRSSI(req) != -999
+}
+
+// getMinGatewayCount returns the min. gateway count of the uplink history.
+func (h *Handler) getMinGatewayCount(req adr.HandleRequest) int {
+	if len(req.UplinkHistory) == 0 {
+		return 0
+	}
+
+	count := req.UplinkHistory[0].GatewayCount
+	for _, m := range req.UplinkHistory[1:] {
+		if m.GatewayCount < count {
+			count = m.GatewayCount
+		}
+	}
+	return count
+}
+
 // getHistoryCount returns the history count with equal TxPowerIndex.
 func (h *Handler) getHistoryCount(req adr.HandleRequest) int {
 	var count int
@@ -90,58 +953,178 @@ func (h *Handler) getHistoryCount(req adr.HandleRequest) int {
 	return count
 }
 
+// getMinDR returns the DR below which the DR is never decreased: the highest
+// of the configured min. DR, the min. allowed DR of the request and the
+// dwell-time min. DR.
+func (h *Handler) getMinDR(req adr.HandleRequest) int {
+	return maxInt(maxInt(h.config.MinDR, req.MinDR), h.getDwellTimeMinDR(req))
+}
+
+// getDwellTimeMinDR returns the min. DR of the uplink dwell-time limitation:
+// DR2 in the AS923 regions when enabled, unless the max. DR is lower.
+// Otherwise it returns 0.
+func (h *Handler) getDwellTimeMinDR(req adr.HandleRequest) int {
+	if !h.config.AS923DwellTime || !strings.HasPrefix(req.Region, "AS923") || req.MaxDR < 2 {
+		return 0
+	}
+	return 2
+}
+
 func (h *Handler) requiredHistoryCount() int {
-	return 20
+	return h.config.RequiredHistoryCount
 }
 
-func (h *Handler) getIdealTxPowerIndexAndDR(nStep, txPowerIndex, dr, maxTxPowerIndex, maxDR int) (int, int) {
-	if nStep == 0 {
-		return txPowerIndex, dr
+// isQuickStart returns true when the uplink history contains at least
+// QuickStartMinFrames elements without any lost frame in between, each with a
+// strong SNR: the SNR margin of the weakest uplink gives at least one step. A
+// reset of the frame-counter counts as lost frame, as the gap is unknown.
+func (h *Handler) isQuickStart(req adr.HandleRequest) bool {
+	if h.config.QuickStartMinFrames == 0 || len(req.UplinkHistory) < h.config.QuickStartMinFrames {
+		return false
 	}
 
-	if nStep > 0 {
-		if dr < maxDR {
-			// Increase the DR.
-			dr++
-		} else if txPowerIndex < maxTxPowerIndex {
-			// Decrease the TxPower.
-			txPowerIndex++
+	for i := 1; i < len(req.UplinkHistory); i++ {
+		gap, ok := h.getFCntGap(req.UplinkHistory[i-1].FCnt, req.UplinkHistory[i].FCnt, req.MACVersion)
+		if !ok || gap != 0 {
+			return false
 		}
-		nStep--
-	} else {
-		if txPowerIndex > 0 {
-			// Increase TxPower.
-			txPowerIndex--
-		} else if txPowerIndex == 0 {
-			if dr > 0 {
-				// Decrease the DR.
-				dr--
+	}
+
+	return h.getMinSNR(req)-h.getRequiredSNR(req)-h.getMargins(req) >= h.getStepSize(req)
+}
+
+// limitSteps clamps the magnitude of nStep to the configured max. number of
+// steps per call and of negative steps.
+func (h *Handler) limitSteps(nStep int) int {
+	if maxDown := h.config.MaxDownSteps; maxDown != 0 && nStep < -maxDown {
+		nStep = -maxDown
+	}
+
+	maxSteps := h.config.MaxStepsPerCall
+	if maxSteps == 0 {
+		return nStep
+	}
+	if nStep > maxSteps {
+		return maxSteps
+	}
+	if nStep < -maxSteps {
+		return -maxSteps
+	}
+	return nStep
+}
+
+// getIdealTxPowerIndexAndDR applies nStep DR / TxPower steps, one step at a
+// time. Positive steps only decrease the TxPower when increaseDR is false,
+// negative steps never decrease the TxPowerIndex below minTxPowerIndex and
+// the DR below minDR. The number of iterations is bounded by the
+// MaxIterations.
+func (h *Handler) getIdealTxPowerIndexAndDR(nStep, txPowerIndex, dr, minTxPowerIndex, maxTxPowerIndex, minDR, maxDR int, increaseDR bool) (int, int) {
+	// Every step moves the DR or TxPowerIndex towards its limit, there can not
+	// be more effective steps than the sum of both ranges.
+	maxIterations := h.config.MaxIterations
+	if maxIterations == 0 {
+		maxIterations = maxInt(dr, maxDR) + maxInt(txPowerIndex, maxTxPowerIndex) + 1
+	}
+
+	for i := 0; nStep != 0; i++ {
+		if i == maxIterations {
+			log.WithFields(log.Fields{
+				"remaining_n_step": nStep,
+				"max_iterations":   maxIterations,
+			}).Warning("Max. number of DR / TxPower iterations reached")
+			break
+		}
+
+		previousTxPowerIndex, previousDR := txPowerIndex, dr
+
+		if nStep > 0 {
+			if increaseDR && dr < maxDR {
+				// Increase the DR.
+				dr++
+			} else if txPowerIndex < maxTxPowerIndex {
+				// Decrease the TxPower.
+				txPowerIndex++
+			}
+			nStep--
+		} else {
+			if txPowerIndex > minTxPowerIndex {
+				// Increase TxPower.
+				txPowerIndex--
+			} else {
+				if dr > minDR && h.config.Mode != modeConservative {
+					// Decrease the DR.
+					dr--
+				}
 			}
+			nStep++
+		}
+
+		// Both are at their limit, the remaining steps have no effect either.
+		if txPowerIndex == previousTxPowerIndex && dr == previousDR {
+			break
 		}
-		nStep++
 	}
 
-	return h.getIdealTxPowerIndexAndDR(nStep, txPowerIndex, dr, maxTxPowerIndex, maxDR)
+	return txPowerIndex, dr
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// isConfirmedDevice returns true when the device is configured to send
+// confirmed uplinks.
+func (h *Handler) isConfirmedDevice(req adr.HandleRequest) bool {
+	devEUI := req.DevEUI.String()
+	for _, s := range h.config.ConfirmedDevEUIs {
+		if strings.EqualFold(s, devEUI) {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *Handler) getNbTrans(currentNbTrans int, pktLossRate float32) int {
-	if currentNbTrans < 1 {
-		currentNbTrans = 1
+	currentNbTrans = h.clampNbTrans(currentNbTrans)
+
+	// The table has a column for the current NbTrans 1, 2 and 3, a higher
+	// NbTrans uses the last column.
+	column := currentNbTrans
+	if column > 3 {
+		column = 3
 	}
 
-	if currentNbTrans > 3 {
-		currentNbTrans = 3
+	row := 3
+	if pktLossRate < h.config.PktLossThresholds[0] {
+		row = 0
+	} else if pktLossRate < h.config.PktLossThresholds[1] {
+		row = 1
+	} else if pktLossRate < h.config.PktLossThresholds[2] {
+		row = 2
 	}
 
-	if pktLossRate < 5 {
-		return h.pktLossRateTable()[0][currentNbTrans-1]
-	} else if pktLossRate < 10 {
-		return h.pktLossRateTable()[1][currentNbTrans-1]
-	} else if pktLossRate < 30 {
-		return h.pktLossRateTable()[2][currentNbTrans-1]
+	nbTrans := h.clampNbTrans(h.pktLossRateTable()[row][column-1])
+
+	// In conservative mode NbTrans is never decreased.
+	if h.config.ConservativeNbTrans && nbTrans < currentNbTrans {
+		return currentNbTrans
 	}
 
-	return h.pktLossRateTable()[3][currentNbTrans-1]
+	return nbTrans
+}
+
+// clampNbTrans clamps the given NbTrans to min_nb_trans - max_nb_trans.
+func (h *Handler) clampNbTrans(nbTrans int) int {
+	if nbTrans > h.config.MaxNbTrans {
+		nbTrans = h.config.MaxNbTrans
+	}
+	if nbTrans < h.config.MinNbTrans {
+		nbTrans = h.config.MinNbTrans
+	}
+	return nbTrans
 }
 
 func (h *Handler) getPacketLossPercentage(req adr.HandleRequest) float32 {
@@ -149,8 +1132,13 @@ func (h *Handler) getPacketLossPercentage(req adr.HandleRequest) float32 {
 		return 0
 	}
 
-	var lostPackets uint32
+	// The packet-loss is the exponential moving average of the expected
+	// frames, replayed from the history: a lost frame counts as 100% and a
+	// received frame as 0% loss. Unlike the ratio over the full history, this
+	// weights recent (burst) losses more heavily.
+	var ema float64
 	var previousFCnt uint32
+	var clampedGaps int
 
 	for i, m := range req.UplinkHistory {
 		if i == 0 {
@@ -158,23 +1146,373 @@ func (h *Handler) getPacketLossPercentage(req adr.HandleRequest) float32 {
 			continue
 		}
 
-		lostPackets += m.FCnt - previousFCnt - 1 // there is always an expected difference of 1
+		// An out-of-order frame-counter (when the history was not normalized)
+		// adds no loss and must not move previousFCnt back, else the frames
+		// up to the next uplink would be counted twice.
+		if d, ok := h.getFCntDistance(previousFCnt, m.FCnt, req.MACVersion); ok && d < 0 {
+			continue
+		}
+
+		gap, ok := h.getFCntGap(previousFCnt, m.FCnt, req.MACVersion)
+
+		// The counter was reset (e.g. after a re-join), this is not a gap.
+		// This splits the history into segments and the lost packets are
+		// only counted within each segment.
+		if !ok {
+			log.WithFields(log.Fields{
+				"dev_eui":       req.DevEUI,
+				"previous_fcnt": previousFCnt,
+				"fcnt":          m.FCnt,
+			}).Debug("Frame-counter reset detected")
+			gap = 0
+		}
+
 		previousFCnt = m.FCnt
+
+		if maxGap := uint32(h.config.PktLossMaxGap); maxGap != 0 && gap > maxGap {
+			gap = maxGap
+			clampedGaps++
+		}
+
+		ema = h.updatePktLossEMA(ema, float64(gap)*h.getGapWeight(req.UplinkHistory[i-1].GatewayCount, m.GatewayCount))
+	}
+
+	if clampedGaps != 0 {
+		log.WithFields(log.Fields{
+			"dev_eui":      req.DevEUI,
+			"clamped_gaps": clampedGaps,
+			"max_gap":      h.config.PktLossMaxGap,
+		}).Debug("Frame-counter gaps clamped")
+	}
+
+	return float32(ema)
+}
+
+// getDevicePacketLossPercentage returns the packet-loss moving average of the
+// device, which is kept across requests. Each request replays the uplinks of
+// the history after the previously handled uplink, with the frames lost in
+// between. The uplinks of requests which returned before the packet-loss was
+// calculated (e.g. during the cooldown) are therefore counted as received.
+// Unseen devices start neutral, without packet-loss.
+func (h *Handler) getDevicePacketLossPercentage(req adr.HandleRequest) float32 {
+	if len(req.UplinkHistory) == 0 {
+		return 0
 	}
+	newest := req.UplinkHistory[len(req.UplinkHistory)-1]
+
+	var ema float64
+	h.devices.update(req.DevEUI.String(), func(device *deviceState) {
+		state := device.pktLoss
+		if state == nil {
+			state = &pktLossState{
+				fCnt:         newest.FCnt,
+				gatewayCount: newest.GatewayCount,
+			}
+			device.pktLoss = state
+		}
+
+		// Only the uplinks after the previously handled uplink are new. The
+		// history is normalized, the frame-counters are unique. Without the
+		// previously handled uplink, e.g. after a reset of the counter, the
+		// complete history is compared with it.
+		history := req.UplinkHistory
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].FCnt == state.fCnt {
+				history = history[i+1:]
+				break
+			}
+		}
+
+		for _, m := range history {
+			d, ok := h.getFCntDistance(state.fCnt, m.FCnt, req.MACVersion)
+
+			// The uplink was already handled (e.g. a retransmission).
+			if ok && d <= 0 {
+				continue
+			}
+
+			// After a reset of the counter, the lost frames are unknown.
+			var gap uint32
+			if ok {
+				gap = uint32(d - 1)
+			}
+
+			if maxGap := uint32(h.config.PktLossMaxGap); maxGap != 0 && gap > maxGap {
+				log.WithFields(log.Fields{
+					"dev_eui": req.DevEUI,
+					"gap":     gap,
+					"max_gap": maxGap,
+				}).Debug("Frame-counter gap clamped")
+				gap = maxGap
+			}
+
+			state.ema = h.updatePktLossEMA(state.ema, float64(gap)*h.getGapWeight(state.gatewayCount, m.GatewayCount))
+			state.fCnt = m.FCnt
+			state.gatewayCount = m.GatewayCount
+		}
+
+		ema = state.ema
+	})
 
-	return float32(lostPackets) / float32(len(req.UplinkHistory)) * 100
+	return float32(ema)
+}
+
+// startCooldown starts the cooldown of the device after a change.
+func (h *Handler) startCooldown(req adr.HandleRequest) {
+	if h.config.CooldownFrames == 0 {
+		return
+	}
+
+	h.devices.update(req.DevEUI.String(), func(device *deviceState) {
+		device.cooldown = h.config.CooldownFrames
+	})
+}
+
+// inCooldown returns true when the device is in cooldown after a change and
+// counts the request.
+func (h *Handler) inCooldown(req adr.HandleRequest) bool {
+	if h.config.CooldownFrames == 0 {
+		return false
+	}
+
+	inCooldown := false
+	h.devices.update(req.DevEUI.String(), func(device *deviceState) {
+		if device.cooldown > 0 {
+			device.cooldown--
+			inCooldown = true
+		}
+	})
+
+	return inCooldown
+}
+
+// updatePktLossEMA returns the packet-loss moving average after gap lost
+// frames followed by a received frame.
+func (h *Handler) updatePktLossEMA(ema float64, gap float64) float64 {
+	alpha := float64(h.config.PktLossEMAAlpha)
+
+	// Applying gap lost frames at once: the remaining distance to 100%
+	// shrinks by (1 - alpha) per frame.
+	ema = 100 - (100-ema)*math.Pow(1-alpha, gap)
+
+	// The received frame.
+	return (1 - alpha) * ema
+}
+
+// getGapWeight returns the weight of the lost frames of a frame-counter gap,
+// given the gateway counts of the uplinks before and after the gap.
+func (h *Handler) getGapWeight(previousGatewayCount, gatewayCount int) float64 {
+	if h.config.PktLossGatewayWeighting && previousGatewayCount <= 1 && gatewayCount <= 1 {
+		return 0.5
+	}
+	return 1
+}
+
+// getFCntGap returns the number of missing frames between the previous and
+// the current frame-counter. It returns false when the counter was reset.
+func (h *Handler) getFCntGap(previousFCnt, fCnt uint32, macVersion string) (uint32, bool) {
+	d, ok := h.getFCntDistance(previousFCnt, fCnt, macVersion)
+	if !ok {
+		return 0, false
+	}
+
+	// A duplicate frame-counter (e.g. a retransmission with NbTrans > 1) or
+	// an out-of-order frame-counter is not a gap.
+	if d <= 0 {
+		return 0, true
+	}
+
+	return uint32(d - 1), true // there is always an expected difference of 1
+}
+
+// getFCntDistance returns the distance from the previous to the current
+// frame-counter, which is negative when the current frame-counter is
+// out-of-order. A rollover of the counter is taken into account, LoRaWAN 1.0
+// devices may use 16-bit counters which roll over at 2^16. It returns false
+// when the counter was reset: it went back by more than maxFCntReorder, or
+// it went back to a value closer to 0 than to the previous frame-counter,
+// e.g. a re-join while the previous counter was still low.
+func (h *Handler) getFCntDistance(previousFCnt, fCnt uint32, macVersion string) (int64, bool) {
+	if fCnt >= previousFCnt {
+		return int64(fCnt - previousFCnt), true
+	}
+
+	forward := fCnt - previousFCnt // modulo 2^32
+	if strings.HasPrefix(macVersion, "1.0") && previousFCnt <= math.MaxUint16 && fCnt <= math.MaxUint16 {
+		forward &= math.MaxUint16 // modulo 2^16
+	}
+	if forward <= maxFCntGap {
+		return int64(forward), true
+	}
+
+	if backward := previousFCnt - fCnt; backward <= maxFCntReorder && fCnt >= backward {
+		return -int64(backward), true
+	}
+
+	return 0, false
+}
+
+// reloadOnSIGHUP reloads the configuration from the given file and flag
+// values on every SIGHUP.
+func (h *Handler) reloadOnSIGHUP(path string, flags map[string]string) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			h.reloadConfig(path, flags)
+		}
+	}()
+}
+
+// reloadConfig loads the configuration from the given file and flag values
+// and replaces the current configuration. On error the current configuration
+// stays active.
+func (h *Handler) reloadConfig(path string, flags map[string]string) {
+	config, err := loadConfig(path, flags)
+	if err != nil {
+		log.WithError(err).Error("Reload configuration error, keeping the current configuration")
+		return
+	}
+
+	h.mu.Lock()
+	changed := h.config.diff(config)
+	h.config = config
+	h.mu.Unlock()
+
+	log.WithFields(changed).Info("Configuration reloaded")
 }
 
 func main() {
-	handler := &Handler{}
+	defaultConfigFile := "/etc/chirpstack-adr/alitecs-adr.toml"
+	if v := os.Getenv(envPrefix + "CONFIG"); v != "" {
+		defaultConfigFile = v
+	}
+
+	configFile := flag.String("config", defaultConfigFile, "path to the configuration file (TOML, or JSON with .json extension)")
+	printDefaultConfig := flag.Bool("print-default-config", false, "print the default configuration as TOML and exit")
+	validateConfig := flag.String("validate-config", "", "validate the given configuration file and exit")
+	simulate := flag.Bool("simulate", false, "read a JSON encoded ADR request from stdin, print the JSON encoded response and exit")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration as JSON and exit")
+	logFormat := flag.String("log-format", os.Getenv(envPrefix+"LOG_FORMAT"), "log format: text or json (overrides "+envPrefix+"LOG_FORMAT)")
+	logLevel := flag.String("log-level", os.Getenv(envPrefix+"LOG_LEVEL"), "log level (overrides "+envPrefix+"LOG_LEVEL)")
+
+	// Every setting which can be set by environment variable can also be set
+	// by flag, e.g. -step-size=3. The flags take precedence.
+	flags := make(map[string]string)
+	defaults := defaultConfig()
+	for _, s := range defaults.settings() {
+		name := s.name
+		flag.Func(flagName(name), "overrides "+envPrefix+name, func(v string) error {
+			flags[name] = v
+			return nil
+		})
+	}
+	flag.Parse()
+
+	switch *logFormat {
+	case "", "text":
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.WithField("log_format", *logFormat).Warning("Invalid log format, falling back to text")
+	}
+
+	if *logLevel != "" {
+		level, err := log.ParseLevel(*logLevel)
+		if err != nil {
+			log.WithError(err).Warning("Invalid log level, falling back to info")
+		} else {
+			log.SetLevel(level)
+		}
+	}
+
+	if *validateConfig != "" {
+		errs := validateFile(*validateConfig)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) != 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
+
+	if *printDefaultConfig {
+		config := defaultConfig()
+		if err := config.writeTOML(os.Stdout); err != nil {
+			log.WithError(err).Fatal("Print configuration error")
+		}
+		return
+	}
+
+	config, err := loadConfig(*configFile, flags)
+	if err != nil {
+		log.WithError(err).Fatal("Load configuration error")
+	}
+
+	if *printConfig {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(config); err != nil {
+			log.WithError(err).Fatal("Print configuration error")
+		}
+		return
+	}
+
+	log.WithFields(config.fields()).Info("Configuration loaded")
+
+	if config.InstallationMarginOverride != nil {
+		log.WithField("installation_margin", *config.InstallationMarginOverride).Info("Installation margin override is active")
+	} else {
+		log.Info("Installation margin override is not set, using the network-server installation margin")
+	}
+
+	handler := &Handler{config: config}
+
+	if *simulate {
+		if err := handler.simulate(os.Stdin, os.Stdout); err != nil {
+			log.WithError(err).Fatal("Simulate error")
+		}
+		return
+	}
+
+	handler.reloadOnSIGHUP(*configFile, flags)
+
+	if addr := os.Getenv(envPrefix + "METRICS_ADDR"); addr != "" {
+		startMetricsServer(addr)
+	}
+
+	healthAddr := os.Getenv(envPrefix + "HEALTH_ADDR")
+	if healthAddr != "" {
+		handler.startHealthServer(healthAddr)
+	}
 
 	pluginMap := map[string]plugin.Plugin{
 		"handler": &adr.HandlerPlugin{Impl: handler},
 	}
 
-	log.Info("Starting ADR plugin")
-	plugin.Serve(&plugin.ServeConfig{
-		HandshakeConfig: adr.HandshakeConfig,
-		Plugins:         pluginMap,
+	log.WithField("version", version).Info("Starting ADR plugin")
+	err = serveMarked(func() {
+		plugin.Serve(&plugin.ServeConfig{
+			HandshakeConfig: adr.HandshakeConfig,
+			Plugins:         pluginMap,
+		})
 	})
+	if err == nil {
+		return
+	}
+
+	log.WithError(err).Error("Serve ADR plugin error")
+	if healthAddr == "" {
+		os.Exit(1)
+	}
+
+	// Keep the health server running, which now returns 503, until the
+	// process is stopped.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	<-sigChan
+	os.Exit(1)
 }
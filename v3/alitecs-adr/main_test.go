@@ -0,0 +1,3391 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/brocaar/chirpstack-network-server/v3/adr"
+	"github.com/hashicorp/go-plugin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// testDevEUI is the DevEUI of the test requests.
+var testDevEUI = [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+// testHandler returns a handler with the default configuration, modified by
+// fn when not nil.
+func testHandler(fn func(c *Config)) *Handler {
+	config := defaultConfig()
+	if fn != nil {
+		fn(&config)
+	}
+	return &Handler{config: config}
+}
+
+// testHistory returns n uplinks with consecutive frame-counters starting at
+// fCnt, with the given SNR and TxPowerIndex, each received by one gateway.
+func testHistory(fCnt uint32, n int, snr float32, txPowerIndex int) []adr.UplinkMetaData {
+	history := make([]adr.UplinkMetaData, n)
+	for i := range history {
+		history[i] = adr.UplinkMetaData{
+			FCnt:         fCnt + uint32(i),
+			MaxSNR:       snr,
+			TXPowerIndex: txPowerIndex,
+			GatewayCount: 1,
+		}
+	}
+	return history
+}
+
+// testFCntHistory returns uplinks with the given frame-counters, an SNR of
+// -10 and TxPowerIndex 3, each received by one gateway.
+func testFCntHistory(fCnts ...uint32) []adr.UplinkMetaData {
+	history := make([]adr.UplinkMetaData, len(fCnts))
+	for i, fCnt := range fCnts {
+		history[i] = adr.UplinkMetaData{
+			FCnt:         fCnt,
+			MaxSNR:       -10,
+			TXPowerIndex: 3,
+			GatewayCount: 1,
+		}
+	}
+	return history
+}
+
+// testFCntRange returns the frame-counters from (including) to (excluding),
+// which may roll over.
+func testFCntRange(from, to uint32) []uint32 {
+	var fCnts []uint32
+	for fCnt := from; fCnt != to; fCnt++ {
+		fCnts = append(fCnts, fCnt)
+	}
+	return fCnts
+}
+
+// testRequest returns a request of a device at DR2, TxPowerIndex 3 and
+// NbTrans 1 with a full uplink history at the given SNR. With the required
+// SNR of -20 dB and the installation margin of 10 dB, the SNR margin is the
+// SNR plus 10 dB: an SNR of -10 gives no steps.
+func testRequest(snr float32) adr.HandleRequest {
+	return adr.HandleRequest{
+		Region:             "EU868",
+		DevEUI:             testDevEUI,
+		MACVersion:         "1.0.3",
+		ADR:                true,
+		DR:                 2,
+		TxPowerIndex:       3,
+		NbTrans:            1,
+		MaxTxPowerIndex:    7,
+		RequiredSNRForDR:   -20,
+		InstallationMargin: 10,
+		MinDR:              0,
+		MaxDR:              5,
+		UplinkHistory:      testHistory(100, 20, snr, 3),
+	}
+}
+
+func TestHandleFCntRollover(t *testing.T) {
+	tests := []struct {
+		name       string
+		macVersion string
+		fCnts      []uint32
+	}{
+		{
+			name:       "32-bit rollover",
+			macVersion: "1.1.0",
+			fCnts:      testFCntRange(4294967290, 14),
+		},
+		{
+			name:       "reset after re-join",
+			macVersion: "1.0.3",
+			fCnts:      append(testFCntRange(5000, 5010), testFCntRange(0, 10)...),
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(nil)
+			req := testRequest(-10)
+			req.MACVersion = tst.macVersion
+			req.UplinkHistory = testFCntHistory(tst.fCnts...)
+
+			if pktLossRate := h.getPacketLossPercentage(req); pktLossRate != 0 {
+				t.Errorf("expected no packet-loss, got %v", pktLossRate)
+			}
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.NbTrans != 1 {
+				t.Errorf("expected NbTrans 1, got %d", resp.NbTrans)
+			}
+		})
+	}
+}
+
+func TestHandleHistoryCount(t *testing.T) {
+	t.Run("empty history", func(t *testing.T) {
+		h := testHandler(func(c *Config) {
+			c.RequiredHistoryCount = 6
+		})
+		req := testRequest(10)
+		req.UplinkHistory = nil
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != (adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1}) {
+			t.Errorf("expected no change, got %+v", resp)
+		}
+	})
+
+	// The history of the network server holds up to 20 uplinks, more than
+	// the required count must not block the TxPower increase.
+	t.Run("negative step with more than the required history", func(t *testing.T) {
+		h := testHandler(func(c *Config) {
+			c.RequiredHistoryCount = 10
+		})
+
+		resp, err := h.Handle(testRequest(-13))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR != 2 || resp.TxPowerIndex != 2 {
+			t.Errorf("expected DR 2 and TxPowerIndex 2, got %+v", resp)
+		}
+	})
+
+	t.Run("negative step with less than the required history", func(t *testing.T) {
+		h := testHandler(func(c *Config) {
+			c.RequiredHistoryCount = 10
+		})
+		req := testRequest(-13)
+		for i := range req.UplinkHistory[:11] {
+			req.UplinkHistory[i].TXPowerIndex = 4
+		}
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR != 2 || resp.TxPowerIndex != 3 {
+			t.Errorf("expected DR 2 and TxPowerIndex 3, got %+v", resp)
+		}
+	})
+
+	t.Run("packet-loss", func(t *testing.T) {
+		req := testRequest(-10)
+		req.UplinkHistory = testFCntHistory(append(testFCntRange(100, 105), testFCntRange(106, 111)...)...)
+
+		if pktLossRate := testHandler(nil).getPacketLossPercentage(req); pktLossRate != 0 {
+			t.Errorf("expected no packet-loss below the required history, got %v", pktLossRate)
+		}
+
+		h := testHandler(func(c *Config) {
+			c.RequiredHistoryCount = 10
+		})
+		if pktLossRate := h.getPacketLossPercentage(req); pktLossRate <= 0 {
+			t.Errorf("expected packet-loss, got %v", pktLossRate)
+		}
+	})
+}
+
+func TestHandleInstallationMarginOverride(t *testing.T) {
+	override := float32(4)
+
+	tests := []struct {
+		name     string
+		override *float32
+		margin   float32
+		dr       int
+	}{
+		{"unset uses the request value", nil, 10, 2},
+		{"set replaces the request value", &override, 4, 4},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.InstallationMarginOverride = tst.override
+			})
+			req := testRequest(-10)
+
+			if margin := h.getInstallationMargin(req); margin != tst.margin {
+				t.Errorf("expected installation margin %v, got %v", tst.margin, margin)
+			}
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.dr {
+				t.Errorf("expected DR %d, got %d", tst.dr, resp.DR)
+			}
+		})
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alitecs-adr.toml")
+	if err := os.WriteFile(path, []byte("step_size = 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := testHandler(nil)
+	h.reloadOnSIGHUP(path, nil)
+
+	stepSize := func() float32 {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return h.config.StepSize
+	}
+
+	// Handle requests concurrently with the reloads, run with -race.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := h.Handle(testRequest(-4)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	if err := os.WriteFile(path, []byte("step_size = 6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stepSize() != 6 {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An invalid file keeps the current configuration.
+	if err := os.WriteFile(path, []byte("step_size = \"abc\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h.reloadConfig(path, nil)
+	if s := stepSize(); s != 6 {
+		t.Errorf("expected step size 6 after an invalid reload, got %v", s)
+	}
+}
+
+// recursiveTxPowerIndexAndDR is the former recursive implementation of
+// getIdealTxPowerIndexAndDR, which is the reference for the iterative
+// implementation.
+func recursiveTxPowerIndexAndDR(nStep, txPowerIndex, dr, maxTxPowerIndex, maxDR int) (int, int) {
+	if nStep == 0 {
+		return txPowerIndex, dr
+	}
+
+	if nStep > 0 {
+		if dr < maxDR {
+			dr++
+		} else if txPowerIndex < maxTxPowerIndex {
+			txPowerIndex++
+		}
+		nStep--
+	} else {
+		if txPowerIndex > 0 {
+			txPowerIndex--
+		} else if dr > 0 {
+			dr--
+		}
+		nStep++
+	}
+
+	return recursiveTxPowerIndexAndDR(nStep, txPowerIndex, dr, maxTxPowerIndex, maxDR)
+}
+
+// TestGetIdealTxPowerIndexAndDRRecursive compares the iterative and the
+// recursive implementation for random device states and all nStep values
+// within -1000 - 1000.
+func TestGetIdealTxPowerIndexAndDRRecursive(t *testing.T) {
+	h := testHandler(nil)
+	rnd := rand.New(rand.NewSource(1))
+
+	for nStep := -1000; nStep <= 1000; nStep++ {
+		for i := 0; i < 20; i++ {
+			maxDR, maxTxPowerIndex := rnd.Intn(16), rnd.Intn(16)
+			dr, txPowerIndex := rnd.Intn(maxDR+1), rnd.Intn(maxTxPowerIndex+1)
+
+			expectedTxPowerIndex, expectedDR := recursiveTxPowerIndexAndDR(nStep, txPowerIndex, dr, maxTxPowerIndex, maxDR)
+			gotTxPowerIndex, gotDR := h.getIdealTxPowerIndexAndDR(nStep, txPowerIndex, dr, 0, maxTxPowerIndex, 0, maxDR, true)
+			if gotTxPowerIndex != expectedTxPowerIndex || gotDR != expectedDR {
+				t.Fatalf("nStep %d, TxPowerIndex %d / %d, DR %d / %d: expected TxPowerIndex %d and DR %d, got %d and %d",
+					nStep, txPowerIndex, maxTxPowerIndex, dr, maxDR, expectedTxPowerIndex, expectedDR, gotTxPowerIndex, gotDR)
+			}
+		}
+	}
+}
+
+func TestGetNbTransConservative(t *testing.T) {
+	normal := testHandler(nil)
+	conservative := testHandler(func(c *Config) {
+		c.ConservativeNbTrans = true
+	})
+
+	decreased := false
+	for currentNbTrans := 1; currentNbTrans <= 3; currentNbTrans++ {
+		for _, pktLossRate := range []float32{0, 7, 20, 50} {
+			if nbTrans := conservative.getNbTrans(currentNbTrans, pktLossRate); nbTrans < currentNbTrans {
+				t.Errorf("NbTrans %d, packet-loss %v: expected no decrease in conservative mode, got %d", currentNbTrans, pktLossRate, nbTrans)
+			}
+			if normal.getNbTrans(currentNbTrans, pktLossRate) < currentNbTrans {
+				decreased = true
+			}
+		}
+	}
+
+	if !decreased {
+		t.Error("expected a decrease in normal mode")
+	}
+	if nbTrans := normal.getNbTrans(3, 0); nbTrans != 2 {
+		t.Errorf("expected NbTrans 2 in normal mode, got %d", nbTrans)
+	}
+	if nbTrans := conservative.getNbTrans(1, 50); nbTrans != 3 {
+		t.Errorf("expected NbTrans 3 in conservative mode, got %d", nbTrans)
+	}
+}
+
+func TestGetFCntGap(t *testing.T) {
+	tests := []struct {
+		name         string
+		macVersion   string
+		previousFCnt uint32
+		fCnt         uint32
+		gap          uint32
+		ok           bool
+	}{
+		{"consecutive", "1.0.3", 100, 101, 0, true},
+		{"one lost", "1.0.3", 100, 102, 1, true},
+		{"duplicate", "1.0.3", 100, 100, 0, true},
+		{"16-bit rollover", "1.0.3", 65535, 0, 0, true},
+		{"16-bit rollover with lost frames", "1.0.3", 65534, 1, 2, true},
+		{"32-bit rollover of a 1.0 device", "1.0.3", 4294967295, 0, 0, true},
+		{"32-bit rollover", "1.1.0", 4294967295, 0, 0, true},
+		{"32-bit rollover with lost frames", "1.1.0", 4294967294, 2, 3, true},
+		{"16-bit wrap of a 1.1 device is a reset", "1.1.0", 65535, 0, 0, false},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			gap, ok := h.getFCntGap(tst.previousFCnt, tst.fCnt, tst.macVersion)
+			if gap != tst.gap || ok != tst.ok {
+				t.Errorf("expected %d, %v, got %d, %v", tst.gap, tst.ok, gap, ok)
+			}
+		})
+	}
+}
+
+func TestGetPacketLossPercentageRollover(t *testing.T) {
+	// The same history, with one lost frame, before and across the rollover
+	// of the counter.
+	tests := []struct {
+		macVersion string
+		from       uint32
+		mask       uint32
+	}{
+		{"1.0.3", 65530, 0xffff},
+		{"1.1.0", 4294967290, 0xffffffff},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.macVersion, func(t *testing.T) {
+			var fCnts, reference []uint32
+			for i := uint32(0); i < 21; i++ {
+				if i != 10 {
+					fCnts = append(fCnts, (tst.from+i)&tst.mask)
+					reference = append(reference, 1000+i)
+				}
+			}
+
+			req := testRequest(-10)
+			req.MACVersion = tst.macVersion
+			req.UplinkHistory = testFCntHistory(reference...)
+			expected := h.getPacketLossPercentage(req)
+
+			req.UplinkHistory = testFCntHistory(fCnts...)
+			if pktLossRate := h.getPacketLossPercentage(req); pktLossRate != expected || expected == 0 {
+				t.Errorf("expected %v, got %v", expected, pktLossRate)
+			}
+		})
+	}
+}
+
+func TestGetPacketLossPercentageReset(t *testing.T) {
+	// The frame-counters relative to the start of each segment. The frames
+	// lost within the segments count, the resets in between do not.
+	tests := []struct {
+		name     string
+		bases    []uint32
+		segments [][]uint32
+	}{
+		{
+			name:  "single reset",
+			bases: []uint32{5000, 0},
+			segments: [][]uint32{
+				{0, 1, 2, 3, 4, 6, 7, 8, 9, 10},
+				{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+			},
+		},
+		{
+			name:  "multiple resets",
+			bases: []uint32{5000, 2000, 0},
+			segments: [][]uint32{
+				{0, 1, 3, 4, 5, 6, 7},
+				{0, 1, 2, 3, 4, 5},
+				{0, 1, 2, 4, 5, 6, 7},
+			},
+		},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			// The reference is a single segment with the same gaps.
+			var fCnts, reference []uint32
+			var offset uint32
+			for i, segment := range tst.segments {
+				for _, fCnt := range segment {
+					fCnts = append(fCnts, tst.bases[i]+fCnt)
+					reference = append(reference, 1000+offset+fCnt)
+				}
+				offset += segment[len(segment)-1] + 1
+			}
+
+			req := testRequest(-10)
+			req.UplinkHistory = testFCntHistory(reference...)
+			expected := h.getPacketLossPercentage(req)
+
+			req.UplinkHistory = testFCntHistory(fCnts...)
+			if pktLossRate := h.getPacketLossPercentage(req); pktLossRate != expected || expected == 0 || expected > 20 {
+				t.Errorf("expected %v, got %v", expected, pktLossRate)
+			}
+		})
+	}
+}
+
+func TestHandleMinDR(t *testing.T) {
+	tests := []struct {
+		name string
+		dr   int
+	}{
+		{"below the min. DR", 0},
+		{"at the min. DR", 2},
+		{"above the min. DR", 4},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			// A margin of -20 dB gives -6 steps.
+			req := testRequest(-30)
+			req.DR = tst.dr
+			req.MinDR = 2
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != 2 {
+				t.Errorf("expected DR 2, got %d", resp.DR)
+			}
+			if resp.TxPowerIndex >= req.TxPowerIndex {
+				t.Errorf("expected a TxPower increase, got TxPowerIndex %d", resp.TxPowerIndex)
+			}
+		})
+	}
+}
+
+func TestGetPacketLossPercentageDuplicates(t *testing.T) {
+	// 20 frames with 2 lost frames, every other frame is received twice.
+	var fCnts, reference []uint32
+	for fCnt := uint32(100); fCnt < 122; fCnt++ {
+		if fCnt == 103 || fCnt == 110 {
+			continue
+		}
+		reference = append(reference, fCnt)
+		fCnts = append(fCnts, fCnt)
+		if fCnt%2 == 0 {
+			fCnts = append(fCnts, fCnt)
+		}
+	}
+
+	h := testHandler(nil)
+	req := testRequest(-10)
+	req.UplinkHistory = testFCntHistory(reference...)
+	expected := h.getPacketLossPercentage(req)
+	if expected == 0 {
+		t.Fatal("expected packet-loss")
+	}
+
+	req.UplinkHistory = testFCntHistory(fCnts...)
+	if pktLossRate := h.getPacketLossPercentage(req); pktLossRate <= 0 || pktLossRate > expected {
+		t.Errorf("expected a packet-loss within 0 - %v without normalization, got %v", expected, pktLossRate)
+	}
+
+	req.UplinkHistory = h.normalizeHistory(req)
+	if pktLossRate := h.getPacketLossPercentage(req); pktLossRate != expected {
+		t.Errorf("expected %v, got %v", expected, pktLossRate)
+	}
+}
+
+// testSequence handles a request per SNR, starting from req, and returns the
+// number of requests which changed the DR, TxPower or NbTrans. Each response
+// is the device state of the next request.
+func testSequence(t *testing.T, h *Handler, req adr.HandleRequest, snrs []float32) int {
+	t.Helper()
+
+	var changes int
+	for _, snr := range snrs {
+		for i := range req.UplinkHistory {
+			req.UplinkHistory[i].MaxSNR = snr
+			req.UplinkHistory[i].TXPowerIndex = req.TxPowerIndex
+		}
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR != req.DR || resp.TxPowerIndex != req.TxPowerIndex || resp.NbTrans != req.NbTrans {
+			changes++
+		}
+		req.DR, req.TxPowerIndex, req.NbTrans = resp.DR, resp.TxPowerIndex, resp.NbTrans
+	}
+	return changes
+}
+
+func TestHandleHysteresis(t *testing.T) {
+	// SNR margins alternating between +3.5 and -3.5 dB.
+	snrs := []float32{-6.5, -13.5, -6.5, -13.5, -6.5, -13.5}
+
+	if changes := testSequence(t, testHandler(nil), testRequest(-10), snrs); changes != len(snrs) {
+		t.Errorf("expected %d changes without hysteresis, got %d", len(snrs), changes)
+	}
+
+	h := testHandler(func(c *Config) {
+		c.HysteresisDB = 4
+	})
+	if changes := testSequence(t, h, testRequest(-10), snrs); changes != 0 {
+		t.Errorf("expected no changes with hysteresis, got %d", changes)
+	}
+
+	// Margins beyond the hysteresis are still applied.
+	if changes := testSequence(t, h, testRequest(-10), []float32{-4}); changes != 1 {
+		t.Errorf("expected a change beyond the hysteresis, got %d", changes)
+	}
+}
+
+func TestGetFCntDistance(t *testing.T) {
+	tests := []struct {
+		name         string
+		previousFCnt uint32
+		fCnt         uint32
+		distance     int64
+		ok           bool
+	}{
+		{"forward", 100, 105, 5, true},
+		{"duplicate", 100, 100, 0, true},
+		{"out-of-order", 100, 90, -10, true},
+		{"out-of-order at a low counter", 5, 3, -2, true},
+		{"max. out-of-order", 1000, 936, -64, true},
+		{"reset", 1000, 935, 0, false},
+		{"re-join with a low counter", 40, 0, 0, false},
+		{"re-join with a low counter, second uplink", 40, 1, 0, false},
+		{"max. forward gap", 100, 100 + 16384, 16384, true},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			distance, ok := h.getFCntDistance(tst.previousFCnt, tst.fCnt, "1.0.3")
+			if distance != tst.distance || ok != tst.ok {
+				t.Errorf("expected %d, %v, got %d, %v", tst.distance, tst.ok, distance, ok)
+			}
+		})
+	}
+}
+
+func TestHandleRejoinWithLowCounter(t *testing.T) {
+	// The device re-joined while the counter of the previous session was 40,
+	// the new session has a bad SNR.
+	h := testHandler(func(c *Config) {
+		c.SNRWindow = 3
+	})
+	req := testRequest(-4)
+	req.UplinkHistory = append(testHistory(21, 20, -4, 3), testHistory(0, 3, -16, 3)...)
+
+	normalized := req
+	normalized.UplinkHistory = h.normalizeHistory(req)
+	if pktLossRate := h.getPacketLossPercentage(normalized); pktLossRate != 0 {
+		t.Errorf("expected no packet-loss, got %v", pktLossRate)
+	}
+	if fCnt := normalized.UplinkHistory[len(normalized.UplinkHistory)-1].FCnt; fCnt != 2 {
+		t.Errorf("expected the new session to be the most recent, got FCnt %d", fCnt)
+	}
+	if snr := h.getSNR(normalized); snr != -16 {
+		t.Errorf("expected the SNR of the new session, got %v", snr)
+	}
+
+	// A margin of -6 dB gives -2 steps.
+	resp, err := h.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DR != 2 || resp.TxPowerIndex != 1 || resp.NbTrans != 1 {
+		t.Errorf("expected DR 2, TxPowerIndex 1 and NbTrans 1, got %+v", resp)
+	}
+}
+
+func TestHandleShuffledHistory(t *testing.T) {
+	h := testHandler(nil)
+
+	req := testRequest(-10)
+	req.UplinkHistory = testFCntHistory(append(testFCntRange(100, 110), testFCntRange(112, 122)...)...)
+	for i := range req.UplinkHistory {
+		req.UplinkHistory[i].MaxSNR = float32(i) - 15
+		req.UplinkHistory[i].TXPowerIndex = 3 + i%2
+	}
+
+	sorted := req
+	sorted.UplinkHistory = h.normalizeHistory(req)
+	pktLossRate := h.getPacketLossPercentage(sorted)
+	maxSNR := h.getMaxSNR(sorted)
+	historyCount := h.getHistoryCount(sorted)
+	expected, err := h.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		shuffled := req
+		shuffled.UplinkHistory = append([]adr.UplinkMetaData(nil), req.UplinkHistory...)
+		rnd.Shuffle(len(shuffled.UplinkHistory), func(i, j int) {
+			shuffled.UplinkHistory[i], shuffled.UplinkHistory[j] = shuffled.UplinkHistory[j], shuffled.UplinkHistory[i]
+		})
+		first := shuffled.UplinkHistory[0]
+
+		normalized := shuffled
+		normalized.UplinkHistory = h.normalizeHistory(shuffled)
+		if v := h.getPacketLossPercentage(normalized); v != pktLossRate {
+			t.Errorf("expected packet-loss %v, got %v", pktLossRate, v)
+		}
+		if v := h.getMaxSNR(normalized); v != maxSNR {
+			t.Errorf("expected max. SNR %v, got %v", maxSNR, v)
+		}
+		if v := h.getHistoryCount(normalized); v != historyCount {
+			t.Errorf("expected history count %d, got %d", historyCount, v)
+		}
+
+		resp, err := h.Handle(shuffled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != expected {
+			t.Errorf("expected %+v, got %+v", expected, resp)
+		}
+
+		if shuffled.UplinkHistory[0] != first {
+			t.Error("expected the history of the request to be unchanged")
+		}
+	}
+}
+
+func TestNormalizeHistory(t *testing.T) {
+	req := testRequest(-10)
+	req.UplinkHistory = []adr.UplinkMetaData{
+		{FCnt: 102, MaxSNR: -5, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 100, MaxSNR: -3, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 101, MaxSNR: -8, MaxRSSI: -90, GatewayCount: 2},
+		{FCnt: 101, MaxSNR: -2, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 104, MaxSNR: -6, MaxRSSI: -100, GatewayCount: 1},
+		// Reset of the counter.
+		{FCnt: 0, MaxSNR: -9, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 1, MaxSNR: -7, MaxRSSI: -110, GatewayCount: 3},
+		{FCnt: 1, MaxSNR: -4, MaxRSSI: -100, GatewayCount: 1},
+	}
+
+	expected := []adr.UplinkMetaData{
+		{FCnt: 100, MaxSNR: -3, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 101, MaxSNR: -2, MaxRSSI: -90, GatewayCount: 2},
+		{FCnt: 102, MaxSNR: -5, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 104, MaxSNR: -6, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 0, MaxSNR: -9, MaxRSSI: -100, GatewayCount: 1},
+		{FCnt: 1, MaxSNR: -4, MaxRSSI: -100, GatewayCount: 3},
+	}
+
+	h := testHandler(nil)
+	history := h.normalizeHistory(req)
+	if len(history) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, history)
+	}
+	for i := range expected {
+		if history[i] != expected[i] {
+			t.Errorf("element %d: expected %+v, got %+v", i, expected[i], history[i])
+		}
+	}
+
+	if req.UplinkHistory[0].FCnt != 102 || req.UplinkHistory[2].MaxSNR != -8 {
+		t.Error("expected the history of the request to be unchanged")
+	}
+}
+
+func TestHandleDuplicatesHistoryCount(t *testing.T) {
+	// 10 frames, each received twice with NbTrans 2, are not enough history.
+	h := testHandler(func(c *Config) {
+		c.QuickStartMinFrames = 0
+	})
+	req := testRequest(-4)
+	req.NbTrans = 2
+	req.UplinkHistory = nil
+	for _, m := range testHistory(100, 10, -4, 3) {
+		req.UplinkHistory = append(req.UplinkHistory, m, m)
+	}
+
+	resp, err := h.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != (adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 2}) {
+		t.Errorf("expected no change, got %+v", resp)
+	}
+}
+
+// testEveryOtherLost returns n uplinks starting at frame-counter 100, with
+// every other frame lost.
+func testEveryOtherLost(n int) []uint32 {
+	fCnts := make([]uint32, n)
+	for i := range fCnts {
+		fCnts[i] = 100 + uint32(2*i)
+	}
+	return fCnts
+}
+
+func TestGetPacketLossPercentageExpectedFrames(t *testing.T) {
+	tests := []struct {
+		name     string
+		fCnts    []uint32
+		maxGap   int
+		min, max float32
+	}{
+		{
+			name:  "no loss",
+			fCnts: testFCntRange(100, 120),
+		},
+		{
+			name:  "every other frame lost",
+			fCnts: testEveryOtherLost(20),
+			min:   40,
+			max:   55,
+		},
+		{
+			// The history has 20 elements, the loss is relative to the
+			// expected frames, not to the history length.
+			name:  "every other frame lost, longer history",
+			fCnts: testEveryOtherLost(60),
+			min:   40,
+			max:   55,
+		},
+		{
+			name:  "huge gaps",
+			fCnts: append(testFCntRange(100, 119), 1000000),
+			min:   0,
+			max:   100,
+		},
+		{
+			name:  "huge gaps everywhere",
+			fCnts: []uint32{0, 10000, 20000, 30000, 40000, 50000, 60000, 70000, 80000, 90000, 100000, 110000, 120000, 130000, 140000, 150000, 160000, 170000, 180000, 190000},
+			min:   80,
+			max:   100,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.PktLossMaxGap = tst.maxGap
+			})
+			req := testRequest(-10)
+			req.MACVersion = "1.1.0"
+			req.UplinkHistory = testFCntHistory(tst.fCnts...)
+
+			pktLossRate := h.getPacketLossPercentage(req)
+			if pktLossRate < tst.min || pktLossRate > tst.max {
+				t.Errorf("expected a packet-loss within %v - %v, got %v", tst.min, tst.max, pktLossRate)
+			}
+		})
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		fn    func(req *adr.HandleRequest)
+		field string
+	}{
+		{name: "valid", fn: func(req *adr.HandleRequest) {}},
+		{name: "valid, DR above MaxDR", fn: func(req *adr.HandleRequest) { req.DR = 7 }},
+		{name: "negative MaxDR", fn: func(req *adr.HandleRequest) { req.MaxDR = -1 }, field: "MaxDR"},
+		{name: "MaxDR above 15", fn: func(req *adr.HandleRequest) { req.MaxDR = 16 }, field: "MaxDR"},
+		{name: "negative MinDR", fn: func(req *adr.HandleRequest) { req.MinDR = -1 }, field: "MinDR"},
+		{name: "MinDR above MaxDR", fn: func(req *adr.HandleRequest) { req.MinDR = 6 }, field: "MinDR"},
+		{name: "negative DR", fn: func(req *adr.HandleRequest) { req.DR = -1 }, field: "DR"},
+		{name: "DR above 15", fn: func(req *adr.HandleRequest) { req.DR = 16 }, field: "DR"},
+		{name: "negative MaxTxPowerIndex", fn: func(req *adr.HandleRequest) { req.MaxTxPowerIndex = -1 }, field: "MaxTxPowerIndex"},
+		{name: "MaxTxPowerIndex above 15", fn: func(req *adr.HandleRequest) { req.MaxTxPowerIndex = 16 }, field: "MaxTxPowerIndex"},
+		{name: "negative TxPowerIndex", fn: func(req *adr.HandleRequest) { req.TxPowerIndex = -1 }, field: "TxPowerIndex"},
+		{name: "TxPowerIndex above 15", fn: func(req *adr.HandleRequest) { req.TxPowerIndex = 16 }, field: "TxPowerIndex"},
+		{name: "NbTrans 0", fn: func(req *adr.HandleRequest) { req.NbTrans = 0 }, field: "NbTrans"},
+		{name: "NbTrans above 15", fn: func(req *adr.HandleRequest) { req.NbTrans = 16 }, field: "NbTrans"},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			tst.fn(&req)
+
+			err := validateRequest(req)
+			if tst.field == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), " "+tst.field+" ") {
+				t.Errorf("expected an error for %s, got %v", tst.field, err)
+			}
+
+			// Handle returns the error before running the algorithm.
+			if _, err := testHandler(nil).Handle(req); err == nil {
+				t.Error("expected Handle to return an error")
+			}
+		})
+	}
+}
+
+// testRawPacketLoss returns the ratio (%) of the lost frames over the
+// expected frames of the given consecutive frame-counters.
+func testRawPacketLoss(fCnts []uint32) float32 {
+	expected := fCnts[len(fCnts)-1] - fCnts[0]
+	received := uint32(len(fCnts) - 1)
+	return float32(expected-received) / float32(expected) * 100
+}
+
+func TestGetPacketLossPercentageBurst(t *testing.T) {
+	// Both histories lose 5 frames in a single burst, the raw ratio is equal.
+	burstOld := append([]uint32{100}, testFCntRange(106, 125)...)
+	burstRecent := append(testFCntRange(100, 115), testFCntRange(120, 125)...)
+	if a, b := testRawPacketLoss(burstOld), testRawPacketLoss(burstRecent); a != b {
+		t.Fatalf("expected an equal raw packet-loss, got %v and %v", a, b)
+	}
+	raw := testRawPacketLoss(burstRecent)
+
+	h := testHandler(nil)
+	req := testRequest(-10)
+
+	req.UplinkHistory = testFCntHistory(burstRecent...)
+	recent := h.getPacketLossPercentage(req)
+	req.UplinkHistory = testFCntHistory(burstOld...)
+	old := h.getPacketLossPercentage(req)
+
+	// The moving average reacts to the recent burst and forgets the old one.
+	if recent <= raw {
+		t.Errorf("expected the packet-loss of a recent burst to exceed the raw packet-loss of %v, got %v", raw, recent)
+	}
+	if old >= raw {
+		t.Errorf("expected the packet-loss of an old burst to be below the raw packet-loss of %v, got %v", raw, old)
+	}
+
+	// A recent burst changes NbTrans, an old burst does not.
+	if nbTrans := h.getNbTrans(1, recent); nbTrans == 1 {
+		t.Errorf("expected the recent burst to increase NbTrans, got %d", nbTrans)
+	}
+	if nbTrans := h.getNbTrans(1, old); nbTrans != 1 {
+		t.Errorf("expected the old burst to keep NbTrans 1, got %d", nbTrans)
+	}
+}
+
+func TestUpdatePktLossEMA(t *testing.T) {
+	tests := []struct {
+		name     string
+		alpha    float32
+		ema, gap float64
+		expected float64
+	}{
+		{"received", 0.1, 50, 0, 45},
+		{"single lost frame", 0.1, 0, 1, 9},
+		{"two lost frames", 0.1, 0, 2, 17.1},
+		{"alpha 0.5", 0.5, 0, 1, 25},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.PktLossEMAAlpha = tst.alpha
+			})
+			if ema := h.updatePktLossEMA(tst.ema, tst.gap); ema < tst.expected-0.001 || ema > tst.expected+0.001 {
+				t.Errorf("expected %v, got %v", tst.expected, ema)
+			}
+		})
+	}
+}
+
+func TestGetPacketLossPercentageMaxGap(t *testing.T) {
+	// 19 uplinks after an outage of 500 frames.
+	outage := append([]uint32{100}, testFCntRange(601, 620)...)
+	// 1 - 3 lost frames in between.
+	ordinary := []uint32{100, 102, 103, 104, 107, 108, 109, 110, 111, 113, 114, 115, 116, 117, 118, 122, 123, 124, 125, 126}
+
+	if h := testHandler(nil); h.config.PktLossMaxGap != 0 {
+		t.Fatalf("expected the cap to be disabled by default, got %d", h.config.PktLossMaxGap)
+	}
+
+	uncapped := testHandler(nil)
+	capped := testHandler(func(c *Config) {
+		c.PktLossMaxGap = 3
+	})
+	req := testRequest(-10)
+
+	// The outage dominates the uncapped packet-loss, but not the capped one.
+	req.UplinkHistory = testFCntHistory(outage...)
+	if pktLossRate := uncapped.getPacketLossPercentage(req); pktLossRate < 10 {
+		t.Errorf("expected the outage to dominate the uncapped packet-loss, got %v", pktLossRate)
+	}
+	pktLossRate := capped.getPacketLossPercentage(req)
+	if pktLossRate >= 5 {
+		t.Errorf("expected the outage not to dominate the capped packet-loss, got %v", pktLossRate)
+	}
+	if nbTrans := capped.getNbTrans(1, pktLossRate); nbTrans != 1 {
+		t.Errorf("expected NbTrans 1, got %d", nbTrans)
+	}
+
+	// Ordinary gaps count fully.
+	req.UplinkHistory = testFCntHistory(ordinary...)
+	if a, b := uncapped.getPacketLossPercentage(req), capped.getPacketLossPercentage(req); a != b || a == 0 {
+		t.Errorf("expected ordinary gaps to count fully, got %v (uncapped) and %v (capped)", a, b)
+	}
+}
+
+func TestHandleStepSize(t *testing.T) {
+	// An SNR margin of 6 dB gives 2 steps of 3 dB or 4 steps of 1.5 dB.
+	for stepSize, expected := range map[float32]int{3: 2, 1.5: 4} {
+		h := testHandler(func(c *Config) {
+			c.StepSize = stepSize
+		})
+		req := testRequest(-4)
+		req.MaxDR = 15
+		req.MaxTxPowerIndex = 15
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR-req.DR != expected {
+			t.Errorf("step size %v: expected %d steps, got DR%d", stepSize, expected, resp.DR)
+		}
+	}
+}
+
+func TestGetDevicePacketLossPercentage(t *testing.T) {
+	h := testHandler(func(c *Config) {
+		c.PktLossPerDevice = true
+	})
+	req := testRequest(-10)
+	req.UplinkHistory = testFCntHistory(testEveryOtherLost(20)...)
+
+	// next adds the uplink after the given number of lost frames to the
+	// history of 20 uplinks.
+	next := func(lost uint32) {
+		newest := req.UplinkHistory[len(req.UplinkHistory)-1].FCnt
+		req.UplinkHistory = append(req.UplinkHistory[1:], testFCntHistory(newest+lost+1)...)
+	}
+
+	// An unseen device starts neutral, regardless of its history.
+	if pktLossRate := h.getDevicePacketLossPercentage(req); pktLossRate != 0 {
+		t.Fatalf("expected an unseen device to start without packet-loss, got %v", pktLossRate)
+	}
+	// The newest uplink was already handled.
+	if pktLossRate := h.getDevicePacketLossPercentage(req); pktLossRate != 0 {
+		t.Fatalf("expected no packet-loss for the same uplink, got %v", pktLossRate)
+	}
+
+	// Every other frame lost converges to ~47%.
+	var previous float32
+	for i := 0; i < 40; i++ {
+		next(1)
+		pktLossRate := h.getDevicePacketLossPercentage(req)
+		if pktLossRate <= previous {
+			t.Fatalf("expected the packet-loss to increase, got %v after %v", pktLossRate, previous)
+		}
+		previous = pktLossRate
+	}
+	if previous < 45 || previous > 48 {
+		t.Errorf("expected the packet-loss to converge to ~47%%, got %v", previous)
+	}
+
+	// Without loss the packet-loss decays.
+	for i := 0; i < 60; i++ {
+		next(0)
+		pktLossRate := h.getDevicePacketLossPercentage(req)
+		if pktLossRate >= previous {
+			t.Fatalf("expected the packet-loss to decrease, got %v after %v", pktLossRate, previous)
+		}
+		previous = pktLossRate
+	}
+	if previous > 1 {
+		t.Errorf("expected the packet-loss to decay, got %v", previous)
+	}
+
+	// Another device has its own state.
+	other := req
+	other.DevEUI = [8]byte{8, 7, 6, 5, 4, 3, 2, 1}
+	other.UplinkHistory = testFCntHistory(testEveryOtherLost(20)...)
+	if pktLossRate := h.getDevicePacketLossPercentage(other); pktLossRate != 0 {
+		t.Errorf("expected the other device to start without packet-loss, got %v", pktLossRate)
+	}
+}
+
+func TestHandlePktLossPerDevice(t *testing.T) {
+	h := testHandler(func(c *Config) {
+		c.PktLossPerDevice = true
+	})
+	req := testRequest(-10)
+	req.UplinkHistory = testFCntHistory(testEveryOtherLost(20)...)
+
+	handle := func(lost uint32) int {
+		newest := req.UplinkHistory[len(req.UplinkHistory)-1].FCnt
+		req.UplinkHistory = append(req.UplinkHistory[1:], testFCntHistory(newest+lost+1)...)
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.DR, req.TxPowerIndex, req.NbTrans = resp.DR, resp.TxPowerIndex, resp.NbTrans
+		return resp.NbTrans
+	}
+
+	// The first request of the device is neutral, the lossy history does
+	// not increase NbTrans.
+	if nbTrans := handle(0); nbTrans != 1 {
+		t.Fatalf("expected NbTrans 1, got %d", nbTrans)
+	}
+
+	for i := 0; i < 40; i++ {
+		handle(1)
+	}
+	if req.NbTrans != 3 {
+		t.Errorf("expected NbTrans 3 after the loss, got %d", req.NbTrans)
+	}
+
+	for i := 0; i < 60; i++ {
+		handle(0)
+	}
+	if req.NbTrans != 1 {
+		t.Errorf("expected NbTrans 1 after the loss decayed, got %d", req.NbTrans)
+	}
+}
+
+func TestHandleRequestMinDR(t *testing.T) {
+	tests := []struct {
+		name               string
+		snr                float32
+		dr, txPowerIndex   int
+		minDR, maxDR       int
+		expectedDR         int
+		expectedTxPowerMin int
+		expectedTxPowerMax int
+	}{
+		{
+			name: "min. DR above the DR, no steps",
+			snr:  -10, dr: 1, txPowerIndex: 3, minDR: 3, maxDR: 5,
+			expectedDR: 3, expectedTxPowerMin: 3, expectedTxPowerMax: 3,
+		},
+		{
+			name: "min. DR above the DR, negative steps",
+			snr:  -30, dr: 1, txPowerIndex: 3, minDR: 3, maxDR: 5,
+			expectedDR: 3, expectedTxPowerMin: 0, expectedTxPowerMax: 2,
+		},
+		{
+			name: "min. DR equals the max. DR, positive steps",
+			snr:  0, dr: 4, txPowerIndex: 3, minDR: 4, maxDR: 4,
+			expectedDR: 4, expectedTxPowerMin: 4, expectedTxPowerMax: 7,
+		},
+		{
+			name: "min. DR equals the max. DR, negative steps",
+			snr:  -30, dr: 4, txPowerIndex: 1, minDR: 4, maxDR: 4,
+			expectedDR: 4, expectedTxPowerMin: 0, expectedTxPowerMax: 1,
+		},
+		{
+			name: "down-stepping to the min. DR",
+			snr:  -40, dr: 4, txPowerIndex: 1, minDR: 2, maxDR: 5,
+			expectedDR: 2, expectedTxPowerMin: 0, expectedTxPowerMax: 1,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(tst.snr)
+			req.DR = tst.dr
+			req.TxPowerIndex = tst.txPowerIndex
+			req.MinDR = tst.minDR
+			req.MaxDR = tst.maxDR
+			req.UplinkHistory = testHistory(100, 20, tst.snr, tst.txPowerIndex)
+
+			resp, err := testHandler(nil).Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+			if resp.TxPowerIndex < tst.expectedTxPowerMin || resp.TxPowerIndex > tst.expectedTxPowerMax {
+				t.Errorf("expected TxPowerIndex %d - %d, got %d", tst.expectedTxPowerMin, tst.expectedTxPowerMax, resp.TxPowerIndex)
+			}
+		})
+	}
+}
+
+func TestHandleMaxTxPowerIndexShrunk(t *testing.T) {
+	tests := []struct {
+		name     string
+		snr      float32
+		dr       int
+		expected adr.HandleResponse
+	}{
+		{"no steps", -10, 2, adr.HandleResponse{DR: 2, TxPowerIndex: 4, NbTrans: 1}},
+		{"positive steps at the max. DR", -4, 5, adr.HandleResponse{DR: 5, TxPowerIndex: 4, NbTrans: 1}},
+		{"positive steps", -4, 2, adr.HandleResponse{DR: 4, TxPowerIndex: 4, NbTrans: 1}},
+		{"negative steps", -16, 2, adr.HandleResponse{DR: 2, TxPowerIndex: 2, NbTrans: 1}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			// The max. TxPowerIndex was lowered from 7 to 4.
+			req := testRequest(tst.snr)
+			req.DR = tst.dr
+			req.TxPowerIndex = 6
+			req.MaxTxPowerIndex = 4
+			req.UplinkHistory = testHistory(100, 20, tst.snr, 6)
+
+			resp, err := testHandler(nil).Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+}
+
+func TestHandleEmptyHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []adr.UplinkMetaData
+	}{
+		{"nil", nil},
+		{"empty", []adr.UplinkMetaData{}},
+		{"single entry without SNR", testHistory(100, 1, -999, 3)},
+		{"single entry, strong SNR", testHistory(100, 1, 20, 3)},
+		{"single entry, weak SNR", testHistory(100, 1, -40, 3)},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = tst.history
+
+			resp, err := testHandler(nil).Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != (adr.HandleResponse{DR: req.DR, TxPowerIndex: req.TxPowerIndex, NbTrans: req.NbTrans}) {
+				t.Errorf("expected no change, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestHandleQuickStart(t *testing.T) {
+	h := testHandler(nil)
+
+	// A new device at DR0 with a margin of 20 dB, which gives 6 steps: the
+	// optimal DR is the max. DR5.
+	req := testRequest(10)
+	req.DR = 0
+	req.TxPowerIndex = 1
+	req.UplinkHistory = nil
+
+	for frame := 1; frame <= 5; frame++ {
+		req.UplinkHistory = testHistory(0, frame, 10, req.TxPowerIndex)
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if frame < 5 {
+			if resp.DR != 0 {
+				t.Fatalf("frame %d: expected DR0 before the quick start, got DR%d", frame, resp.DR)
+			}
+			continue
+		}
+		if resp.DR != 5 {
+			t.Errorf("frame %d: expected the optimal DR5, got DR%d", frame, resp.DR)
+		}
+	}
+
+	// A lost frame disables the quick start.
+	req.UplinkHistory = testFCntHistory(0, 1, 3, 4, 5)
+	for i := range req.UplinkHistory {
+		req.UplinkHistory[i].MaxSNR = 10
+		req.UplinkHistory[i].TXPowerIndex = req.TxPowerIndex
+	}
+	if resp, err := h.Handle(req); err != nil || resp.DR != 0 {
+		t.Errorf("expected DR0 with a lost frame, got %+v (%v)", resp, err)
+	}
+
+	// A weak uplink disables the quick start: its margin of 2 dB gives no
+	// steps.
+	req.UplinkHistory = testHistory(0, 5, 10, req.TxPowerIndex)
+	req.UplinkHistory[2].MaxSNR = -8
+	if resp, err := h.Handle(req); err != nil || resp.DR != 0 {
+		t.Errorf("expected DR0 with a weak uplink, got %+v (%v)", resp, err)
+	}
+	req.UplinkHistory[2].MaxSNR = -7
+	if resp, err := h.Handle(req); err != nil || resp.DR != 5 {
+		t.Errorf("expected DR5 with a margin of one step, got %+v (%v)", resp, err)
+	}
+
+	// The TxPower is not increased before the full history is available.
+	req = testRequest(-30)
+	req.UplinkHistory = testHistory(0, 5, -30, req.TxPowerIndex)
+	resp, err := h.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != (adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1}) {
+		t.Errorf("expected no change, got %+v", resp)
+	}
+}
+
+// testLogHook returns a hook which records the entries of the standard
+// logger, until the end of the test.
+func testLogHook(t *testing.T) *logtest.Hook {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() {
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	})
+	return hook
+}
+
+// TestGetIdealTxPowerIndexAndDRExhaustive compares the iterative and the
+// recursive implementation for all device states and all nStep values which
+// can have an effect.
+func TestGetIdealTxPowerIndexAndDRExhaustive(t *testing.T) {
+	h := testHandler(nil)
+	hook := testLogHook(t)
+
+	for maxDR := 0; maxDR <= 15; maxDR++ {
+		for maxTxPowerIndex := 0; maxTxPowerIndex <= 15; maxTxPowerIndex++ {
+			for dr := 0; dr <= maxDR; dr++ {
+				for txPowerIndex := 0; txPowerIndex <= maxTxPowerIndex; txPowerIndex++ {
+					for nStep := -32; nStep <= 32; nStep++ {
+						expectedTxPowerIndex, expectedDR := recursiveTxPowerIndexAndDR(nStep, txPowerIndex, dr, maxTxPowerIndex, maxDR)
+						gotTxPowerIndex, gotDR := h.getIdealTxPowerIndexAndDR(nStep, txPowerIndex, dr, 0, maxTxPowerIndex, 0, maxDR, true)
+						if gotTxPowerIndex != expectedTxPowerIndex || gotDR != expectedDR {
+							t.Fatalf("nStep %d, TxPowerIndex %d / %d, DR %d / %d: expected TxPowerIndex %d and DR %d, got %d and %d",
+								nStep, txPowerIndex, maxTxPowerIndex, dr, maxDR, expectedTxPowerIndex, expectedDR, gotTxPowerIndex, gotDR)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// The default cap is never reached.
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.WarnLevel {
+			t.Errorf("expected no warning, got %q", e.Message)
+		}
+	}
+}
+
+func TestGetIdealTxPowerIndexAndDRMaxIterations(t *testing.T) {
+	h := testHandler(func(c *Config) {
+		c.MaxIterations = 2
+	})
+	hook := testLogHook(t)
+
+	// Only 2 of the 10 steps are applied.
+	txPowerIndex, dr := h.getIdealTxPowerIndexAndDR(10, 3, 1, 0, 7, 0, 5, true)
+	if txPowerIndex != 3 || dr != 3 {
+		t.Errorf("expected TxPowerIndex 3 and DR3, got %d and DR%d", txPowerIndex, dr)
+	}
+
+	e := hook.LastEntry()
+	if e == nil || e.Level != log.WarnLevel || e.Data["remaining_n_step"] != 8 {
+		t.Errorf("expected a warning with 8 remaining steps, got %+v", e)
+	}
+
+	// Steps within the cap do not log a warning.
+	hook.Reset()
+	if txPowerIndex, dr := h.getIdealTxPowerIndexAndDR(2, 3, 1, 0, 7, 0, 5, true); txPowerIndex != 3 || dr != 3 {
+		t.Errorf("expected TxPowerIndex 3 and DR3, got %d and DR%d", txPowerIndex, dr)
+	}
+	if len(hook.AllEntries()) != 0 {
+		t.Errorf("expected no warning, got %+v", hook.LastEntry())
+	}
+}
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       func(req *adr.HandleRequest)
+		expected adr.HandleResponse
+	}{
+		{
+			name: "ADR disabled",
+			fn: func(req *adr.HandleRequest) {
+				req.ADR = false
+				req.UplinkHistory = testHistory(100, 20, 10, 3)
+			},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name: "DR above the max. DR",
+			fn: func(req *adr.HandleRequest) {
+				req.DR = 7
+			},
+			expected: adr.HandleResponse{DR: 5, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name:     "zero steps",
+			fn:       func(req *adr.HandleRequest) {},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name: "positive steps",
+			fn: func(req *adr.HandleRequest) {
+				req.UplinkHistory = testHistory(100, 20, -4, 3)
+			},
+			expected: adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name: "positive steps, DR reaches the max. DR",
+			fn: func(req *adr.HandleRequest) {
+				req.UplinkHistory = testHistory(100, 20, 2, 3)
+			},
+			expected: adr.HandleResponse{DR: 5, TxPowerIndex: 4, NbTrans: 1},
+		},
+		{
+			name: "negative steps",
+			fn: func(req *adr.HandleRequest) {
+				req.UplinkHistory = testHistory(100, 20, -16, 3)
+			},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 1, NbTrans: 1},
+		},
+		{
+			name: "negative steps, TxPower reaches the max. TxPower",
+			fn: func(req *adr.HandleRequest) {
+				req.TxPowerIndex = 1
+				req.UplinkHistory = testHistory(100, 20, -16, 1)
+			},
+			expected: adr.HandleResponse{DR: 1, TxPowerIndex: 0, NbTrans: 1},
+		},
+		{
+			name: "negative steps, not enough history with equal TxPowerIndex",
+			fn: func(req *adr.HandleRequest) {
+				req.UplinkHistory = append(testHistory(100, 10, -16, 4), testHistory(110, 10, -16, 3)...)
+			},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name: "positive steps, not enough history with equal TxPowerIndex",
+			fn: func(req *adr.HandleRequest) {
+				req.UplinkHistory = append(testHistory(100, 10, -4, 4), testHistory(110, 10, -4, 3)...)
+			},
+			expected: adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 1},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			tst.fn(&req)
+
+			resp, err := testHandler(nil).Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+}
+
+func TestHandleNbTrans(t *testing.T) {
+	// The packet-loss of 19 received frames followed by a gap of lost frames
+	// and the last frame: 0%, 9%, 17.1% and 36.9%.
+	gaps := []uint32{0, 1, 2, 5}
+
+	for row, gap := range gaps {
+		for nbTrans := 1; nbTrans <= 3; nbTrans++ {
+			req := testRequest(-10)
+			req.NbTrans = nbTrans
+			req.UplinkHistory = testFCntHistory(append(testFCntRange(100, 119), 119+gap)...)
+
+			resp, err := testHandler(nil).Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := defaultConfig().PktLossRateTable[row][nbTrans-1]
+			if resp.NbTrans != expected {
+				t.Errorf("gap %d, NbTrans %d: expected NbTrans %d, got %d", gap, nbTrans, expected, resp.NbTrans)
+			}
+		}
+	}
+}
+
+func TestGetIdealTxPowerIndexAndDRBoundaries(t *testing.T) {
+	tests := []struct {
+		name                 string
+		nStep                int
+		txPowerIndex, dr     int
+		increaseDR           bool
+		expectedTxPowerIndex int
+		expectedDR           int
+	}{
+		{"positive steps beyond both limits", 1000, 0, 0, true, 7, 5},
+		{"positive steps beyond the max. TxPowerIndex", 1000, 0, 0, false, 7, 0},
+		{"negative steps beyond both limits", -1000, 7, 5, true, 0, 0},
+		{"positive steps at both limits", 1, 7, 5, true, 7, 5},
+		{"negative steps at both limits", -1, 0, 0, true, 0, 0},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			txPowerIndex, dr := h.getIdealTxPowerIndexAndDR(tst.nStep, tst.txPowerIndex, tst.dr, 0, 7, 0, 5, tst.increaseDR)
+			if txPowerIndex != tst.expectedTxPowerIndex || dr != tst.expectedDR {
+				t.Errorf("expected TxPowerIndex %d and DR%d, got %d and DR%d", tst.expectedTxPowerIndex, tst.expectedDR, txPowerIndex, dr)
+			}
+		})
+	}
+}
+
+// testLinkSequence handles n requests of a device at its max. DR, whose SNR
+// margin is margin at TxPowerIndex 3, drops 3 dB per TxPowerIndex and
+// alternates by +/- fading dB. It returns the number of requests which
+// changed the TxPower.
+func testLinkSequence(t *testing.T, h *Handler, n int, margin, fading float32) int {
+	t.Helper()
+
+	req := testRequest(-10)
+	req.MaxDR = req.DR
+
+	var changes int
+	for i := 0; i < n; i++ {
+		snr := -10 + margin - 3*float32(req.TxPowerIndex-3) + fading
+		fading = -fading
+		req.UplinkHistory = testHistory(uint32(100+20*i), 20, snr, req.TxPowerIndex)
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.TxPowerIndex != req.TxPowerIndex {
+			changes++
+		}
+		req.TxPowerIndex = resp.TxPowerIndex
+	}
+	return changes
+}
+
+func TestHandleAsymmetricHysteresis(t *testing.T) {
+	up, down := float32(5), float32(1)
+	asymmetric := testHandler(func(c *Config) {
+		c.HysteresisUpDB = &up
+		c.HysteresisDownDB = &down
+	})
+
+	// At TxPowerIndex 3 the margin alternates between +3.5 and -0.5 dB, a
+	// TxPower decrease is followed by a margin of -3.5 dB.
+	if changes := testLinkSequence(t, testHandler(nil), 10, 1.5, 2); changes != 10 {
+		t.Errorf("expected the TxPower to change at every request without hysteresis, got %d changes", changes)
+	}
+	if changes := testLinkSequence(t, asymmetric, 10, 1.5, 2); changes != 0 {
+		t.Errorf("expected a stable TxPower with the asymmetric hysteresis, got %d changes", changes)
+	}
+
+	// A degrading link still increases the TxPower right away, which the
+	// same symmetric hysteresis would not.
+	if changes := testLinkSequence(t, asymmetric, 1, -4, 0); changes != 1 {
+		t.Errorf("expected a TxPower increase with the asymmetric hysteresis, got %d changes", changes)
+	}
+	symmetric := testHandler(func(c *Config) {
+		c.HysteresisDB = up
+	})
+	if changes := testLinkSequence(t, symmetric, 1, -4, 0); changes != 0 {
+		t.Errorf("expected no TxPower increase with the symmetric hysteresis, got %d changes", changes)
+	}
+}
+
+func TestHandleNoSNR(t *testing.T) {
+	tests := []struct {
+		name     string
+		history  []adr.UplinkMetaData
+		expected adr.HandleResponse
+	}{
+		{
+			name:     "zero-length history",
+			history:  []adr.UplinkMetaData{},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name:     "all SNRs at the sentinel",
+			history:  testHistory(100, 20, -999, 3),
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name:     "all SNRs at the sentinel, quick start",
+			history:  testHistory(100, 5, -999, 3),
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			// The uplinks without SNR are ignored by the max. SNR.
+			name:     "some SNRs at the sentinel",
+			history:  append(testHistory(100, 10, -999, 3), testHistory(110, 10, -4, 3)...),
+			expected: adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 1},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = tst.history
+
+			resp, err := testHandler(nil).Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+}
+
+func TestHandleCooldown(t *testing.T) {
+	h := testHandler(func(c *Config) {
+		c.CooldownFrames = 2
+	})
+
+	handle := func(req adr.HandleRequest) adr.HandleResponse {
+		t.Helper()
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Requests without a change do not start the cooldown.
+	req := testRequest(-10)
+	handle(req)
+
+	// Each request has a margin of 3 dB, which gives a step.
+	req = testRequest(-7)
+	for i, expectedDR := range []int{3, 3, 3, 4, 4, 4, 5} {
+		resp := handle(req)
+		if resp.DR != expectedDR {
+			t.Errorf("request %d: expected DR%d, got DR%d", i, expectedDR, resp.DR)
+		}
+		req.DR = resp.DR
+	}
+
+	// The cooldown is per device, the device is still in the cooldown of
+	// the last change.
+	req = testRequest(-7)
+	req.DR = 3
+
+	other := testRequest(-7)
+	other.DevEUI = [8]byte{8, 7, 6, 5, 4, 3, 2, 1}
+	if resp := handle(other); resp.DR != 3 {
+		t.Errorf("expected DR3 for the other device, got DR%d", resp.DR)
+	}
+	if resp := handle(req); resp.DR != 3 {
+		t.Errorf("expected DR3 during the cooldown, got DR%d", resp.DR)
+	}
+}
+
+func TestHandleInstallationMarginClamp(t *testing.T) {
+	float32Ptr := func(f float32) *float32 { return &f }
+
+	tests := []struct {
+		name       string
+		min, max   *float32
+		snr        float32
+		margin     float32
+		expectedDR int
+	}{
+		{"unset", nil, nil, -10, 10, 2},
+		{"within the range", float32Ptr(5), float32Ptr(15), -10, 10, 2},
+		{"clamped to the max.", nil, float32Ptr(4), -10, 4, 4},
+		{"clamped to the min.", float32Ptr(13), nil, -4, 13, 3},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.InstallationMarginMin = tst.min
+				c.InstallationMarginMax = tst.max
+			})
+			hook := testLogHook(t)
+			req := testRequest(tst.snr)
+
+			if margin := h.getInstallationMargin(req); margin != tst.margin {
+				t.Errorf("expected installation margin %v, got %v", tst.margin, margin)
+			}
+
+			for i := 0; i < 3; i++ {
+				resp, err := h.Handle(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.DR != tst.expectedDR {
+					t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+				}
+			}
+
+			// The clamp is logged once.
+			var warnings int
+			for _, e := range hook.AllEntries() {
+				if e.Level == log.WarnLevel {
+					warnings++
+				}
+			}
+			expected := 0
+			if tst.margin != req.InstallationMargin {
+				expected = 1
+			}
+			if warnings != expected {
+				t.Errorf("expected %d warnings, got %d", expected, warnings)
+			}
+		})
+	}
+}
+
+func TestGetPacketLossPercentage(t *testing.T) {
+	tests := []struct {
+		name            string
+		fCnts           []uint32
+		nbTrans         int
+		expected        float32
+		expectedNbTrans int
+	}{
+		{
+			name:            "empty history",
+			nbTrans:         2,
+			expectedNbTrans: 1,
+		},
+		{
+			name:            "shorter than the required history",
+			fCnts:           []uint32{100, 105, 110, 115, 120},
+			nbTrans:         2,
+			expectedNbTrans: 1,
+		},
+		{
+			name:            "exactly the required history",
+			fCnts:           append(testFCntRange(100, 119), 120),
+			nbTrans:         2,
+			expected:        9,
+			expectedNbTrans: 2,
+		},
+		{
+			name:            "no lost frames",
+			fCnts:           testFCntRange(100, 120),
+			nbTrans:         3,
+			expectedNbTrans: 2,
+		},
+		{
+			// All frames in between the received frames are lost.
+			name:            "100% packet-loss",
+			fCnts:           []uint32{0, 10000, 20000, 30000, 40000, 50000, 60000, 70000, 80000, 90000, 100000, 110000, 120000, 130000, 140000, 150000, 160000, 170000, 180000, 190000},
+			nbTrans:         1,
+			expected:        90,
+			expectedNbTrans: 3,
+		},
+		{
+			name:            "gap of 2, recent",
+			fCnts:           append(testFCntRange(100, 119), 120),
+			nbTrans:         1,
+			expected:        9,
+			expectedNbTrans: 1,
+		},
+		{
+			name:            "gap of 2, old",
+			fCnts:           append([]uint32{100}, testFCntRange(102, 121)...),
+			nbTrans:         1,
+			expected:        1.3509,
+			expectedNbTrans: 1,
+		},
+		{
+			name:            "mixed",
+			fCnts:           append(append([]uint32{100, 101, 103, 104, 107}, testFCntRange(108, 120)...), 121, 122, 126),
+			nbTrans:         1,
+			expected:        32.812,
+			expectedNbTrans: 3,
+		},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = testFCntHistory(tst.fCnts...)
+
+			pktLossRate := h.getPacketLossPercentage(req)
+			if pktLossRate < tst.expected-0.001 || pktLossRate > tst.expected+0.001 {
+				t.Errorf("expected packet-loss %v, got %v", tst.expected, pktLossRate)
+			}
+			if nbTrans := h.getNbTrans(tst.nbTrans, pktLossRate); nbTrans != tst.expectedNbTrans {
+				t.Errorf("expected NbTrans %d, got %d", tst.expectedNbTrans, nbTrans)
+			}
+		})
+	}
+}
+
+func TestHandleMaxStepsPerCall(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSteps int
+		snr      float32
+		expected adr.HandleResponse
+	}{
+		{"unlimited, positive steps", 0, 5, adr.HandleResponse{DR: 7, TxPowerIndex: 3, NbTrans: 1}},
+		{"limited, positive steps", 2, 5, adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 1}},
+		{"limit above the steps", 6, 5, adr.HandleResponse{DR: 7, TxPowerIndex: 3, NbTrans: 1}},
+		{"limited, negative steps", 2, -25, adr.HandleResponse{DR: 2, TxPowerIndex: 1, NbTrans: 1}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.MaxStepsPerCall = tst.maxSteps
+			})
+
+			// A margin of 15 or -15 dB gives 5 or -5 steps.
+			req := testRequest(tst.snr)
+			req.MaxDR = 15
+			req.MaxTxPowerIndex = 15
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+}
+
+func TestGetIdealTxPowerIndexAndDR(t *testing.T) {
+	// The max. TxPowerIndex is 7 and the max. DR5.
+	tests := []struct {
+		name                 string
+		nStep                int
+		txPowerIndex, dr     int
+		minTxPowerIndex      int
+		minDR                int
+		increaseDR           bool
+		expectedTxPowerIndex int
+		expectedDR           int
+	}{
+		{"no steps", 0, 3, 2, 0, 0, false, 3, 2},
+		{"positive step, DR below the max.", 1, 3, 2, 0, 0, true, 3, 3},
+		{"positive step, DR at the max.", 1, 3, 5, 0, 0, true, 4, 5},
+		{"positive step, both at the max.", 1, 7, 5, 0, 0, true, 7, 5},
+		{"positive step, no DR increase", 1, 3, 2, 0, 0, false, 4, 2},
+		{"negative step, TxPowerIndex above the min.", -1, 3, 2, 0, 0, true, 2, 2},
+		{"negative step, TxPowerIndex at the configured min.", -1, 2, 3, 2, 1, true, 2, 2},
+		{"negative step, both at the configured min.", -1, 2, 1, 2, 1, true, 2, 1},
+		{"large positive steps", 100, 0, 0, 0, 0, true, 7, 5},
+		{"large positive steps, no DR increase", 100, 3, 2, 0, 0, false, 7, 2},
+		{"large negative steps to the configured min.", -100, 7, 5, 2, 1, true, 2, 1},
+		{"negative step, TxPowerIndex 0", -1, 0, 2, 0, 0, true, 0, 1},
+		{"negative step, TxPowerIndex 0 and DR0", -1, 0, 0, 0, 0, true, 0, 0},
+		{"large negative steps", -100, 7, 5, 0, 0, true, 0, 0},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			txPowerIndex, dr := h.getIdealTxPowerIndexAndDR(tst.nStep, tst.txPowerIndex, tst.dr, tst.minTxPowerIndex, 7, tst.minDR, 5, tst.increaseDR)
+			if txPowerIndex != tst.expectedTxPowerIndex || dr != tst.expectedDR {
+				t.Errorf("expected TxPowerIndex %d and DR%d, got %d and DR%d", tst.expectedTxPowerIndex, tst.expectedDR, txPowerIndex, dr)
+			}
+
+			minTxPowerIndex := tst.minTxPowerIndex
+			if txPowerIndex < minTxPowerIndex || txPowerIndex > 7 {
+				t.Errorf("TxPowerIndex %d is outside %d - 7", txPowerIndex, minTxPowerIndex)
+			}
+			if dr < tst.minDR || dr > 5 {
+				t.Errorf("DR%d is outside DR%d - DR5", dr, tst.minDR)
+			}
+		})
+	}
+}
+
+func TestHandleDRMargin(t *testing.T) {
+	tests := []struct {
+		name       string
+		drMargin   map[string]float32
+		expectedDR int
+	}{
+		{"flat margin", nil, 4},
+		{"margin of the current DR", map[string]float32{"2": 3}, 3},
+		{"margin of the target DR limits the increase", map[string]float32{"3": 2, "4": 4}, 3},
+		{"margin of the target DR blocks the increase", map[string]float32{"3": 4, "4": 4}, 2},
+		{"missing entries", map[string]float32{"0": 10, "5": 10}, 4},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.DRMargin = tst.drMargin
+			})
+
+			// A flat margin of 6 dB gives 2 steps.
+			resp, err := h.Handle(testRequest(-4))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+}
+
+func TestHandleMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		snr          float32
+		txPowerIndex int
+		expected     adr.HandleResponse
+	}{
+		{"symmetric, improving link", modeSymmetric, -4, 3, adr.HandleResponse{DR: 5, TxPowerIndex: 3, NbTrans: 1}},
+		{"conservative, improving link", modeConservative, -4, 3, adr.HandleResponse{DR: 5, TxPowerIndex: 3, NbTrans: 1}},
+		{"symmetric, degrading link", modeSymmetric, -16, 3, adr.HandleResponse{DR: 3, TxPowerIndex: 1, NbTrans: 1}},
+		{"conservative, degrading link", modeConservative, -16, 3, adr.HandleResponse{DR: 3, TxPowerIndex: 1, NbTrans: 1}},
+		{"symmetric, degrading link at the max. TxPower", modeSymmetric, -16, 1, adr.HandleResponse{DR: 1, TxPowerIndex: 1, NbTrans: 1}},
+		{"conservative, degrading link at the max. TxPower", modeConservative, -16, 1, adr.HandleResponse{DR: 3, TxPowerIndex: 1, NbTrans: 1}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.Mode = tst.mode
+				c.MinTxPowerIndex = 1
+			})
+
+			// A margin of 6 or -6 dB gives 2 or -2 steps.
+			req := testRequest(tst.snr)
+			req.DR = 3
+			req.TxPowerIndex = tst.txPowerIndex
+			req.UplinkHistory = testHistory(100, 20, tst.snr, tst.txPowerIndex)
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+}
+
+func TestHandlePluginRPC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reattachCh := make(chan *plugin.ReattachConfig, 1)
+	closeCh := make(chan struct{})
+
+	go plugin.Serve(&plugin.ServeConfig{
+		HandshakeConfig: adr.HandshakeConfig,
+		Plugins: map[string]plugin.Plugin{
+			"handler": &adr.HandlerPlugin{Impl: testHandler(nil)},
+		},
+		Test: &plugin.ServeTestConfig{
+			Context:          ctx,
+			ReattachConfigCh: reattachCh,
+			CloseCh:          closeCh,
+		},
+	})
+	defer func() {
+		cancel()
+		<-closeCh
+	}()
+
+	var reattach *plugin.ReattachConfig
+	select {
+	case reattach = <-reattachCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the plugin")
+	}
+
+	client := plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig: adr.HandshakeConfig,
+		Plugins: map[string]plugin.Plugin{
+			"handler": &adr.HandlerPlugin{},
+		},
+		Reattach: reattach,
+	})
+
+	// The server stops after the connection is closed. The client is not
+	// killed, the plugin runs in the test process.
+	rpcClient, err := client.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpcClient.Close()
+	raw, err := rpcClient.Dispense("handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := raw.(adr.Handler)
+
+	if id, err := handler.ID(); err != nil || id != "alitecs-adr" {
+		t.Errorf("expected ID alitecs-adr, got %q (%v)", id, err)
+	}
+
+	// A margin of 6 dB gives 2 steps, 2 lost frames give NbTrans 2.
+	req := testRequest(-4)
+	req.UplinkHistory = testHistory(100, 20, -4, 3)
+	req.UplinkHistory[19].FCnt = 121
+	req.UplinkHistory[19].MaxRSSI = -110
+
+	resp, err := handler.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := testHandler(nil).Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != expected || resp != (adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 2}) {
+		t.Errorf("expected %+v, got %+v", expected, resp)
+	}
+
+	// Errors are returned to the client.
+	req.NbTrans = 0
+	if _, err := handler.Handle(req); err == nil || !strings.Contains(err.Error(), "NbTrans") {
+		t.Errorf("expected a NbTrans error, got %v", err)
+	}
+}
+
+// testOutlierHistory returns 20 uplinks at an SNR of -10, except for one
+// uplink at the given SNR.
+func testOutlierHistory(snr float32) []adr.UplinkMetaData {
+	history := testHistory(100, 20, -10, 3)
+	history[12].MaxSNR = snr
+	return history
+}
+
+func TestHandleMeanSNR(t *testing.T) {
+	tests := []struct {
+		strategy   string
+		expectedDR int
+	}{
+		{snrStrategyMax, 5},
+		{snrStrategyAvg, 2},
+		{snrStrategyMean, 2},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.strategy, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRStrategy = tst.strategy
+			})
+
+			// The max. SNR margin is 18 dB (6 steps), the mean SNR margin is
+			// 0.9 dB (no steps).
+			req := testRequest(-10)
+			req.UplinkHistory = testOutlierHistory(8)
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+
+	h := testHandler(nil)
+	req := testRequest(-10)
+	req.UplinkHistory = testOutlierHistory(8)
+	if snr := h.getMeanSNR(req); snr < -9.1001 || snr > -9.0999 {
+		t.Errorf("expected a mean SNR of -9.1, got %v", snr)
+	}
+	if snr := h.getMeanSNR(adr.HandleRequest{}); snr != -999 {
+		t.Errorf("expected -999 for an empty history, got %v", snr)
+	}
+}
+
+// testSNRHistory returns uplinks with consecutive frame-counters and the
+// given SNRs.
+func testSNRHistory(snrs ...float32) []adr.UplinkMetaData {
+	history := testHistory(100, len(snrs), 0, 3)
+	for i, snr := range snrs {
+		history[i].MaxSNR = snr
+	}
+	return history
+}
+
+func TestGetPercentileSNR(t *testing.T) {
+	tests := []struct {
+		name     string
+		snrs     []float32
+		p        float64
+		expected float32
+	}{
+		{"empty history", nil, 50, -999},
+		{"single entry", []float32{-7}, 90, -7},
+		{"p0", []float32{-2, -10, -6, -4, -8}, 0, -10},
+		{"p25", []float32{-2, -10, -6, -4, -8}, 25, -8},
+		{"median", []float32{-2, -10, -6, -4, -8}, 50, -6},
+		{"p90, interpolated", []float32{-2, -10, -6, -4, -8}, 90, -2.8},
+		{"p100", []float32{-2, -10, -6, -4, -8}, 100, -2},
+		{"median of two, interpolated", []float32{-4, -10}, 50, -7},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = testSNRHistory(tst.snrs...)
+
+			if snr := h.getPercentileSNR(req, tst.p); snr < tst.expected-0.0001 || snr > tst.expected+0.0001 {
+				t.Errorf("expected %v, got %v", tst.expected, snr)
+			}
+		})
+	}
+}
+
+func TestHandlePercentileSNR(t *testing.T) {
+	tests := []struct {
+		strategy   string
+		expectedDR int
+	}{
+		// The outlier gives 6 steps.
+		{snrStrategyMax, 5},
+		{snrStrategyMedian, 2},
+		{"p25", 2},
+		// p97 interpolates between -10 and the outlier at 8: -10 + 0.43 * 18
+		// gives a margin of 7.74 dB (2 steps).
+		{"p97", 4},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.strategy, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRStrategy = tst.strategy
+			})
+			req := testRequest(-10)
+			req.UplinkHistory = testOutlierHistory(8)
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+
+			// An empty history keeps the current values.
+			req.UplinkHistory = nil
+			if resp, err := h.Handle(req); err != nil || resp.DR != req.DR {
+				t.Errorf("expected DR%d for an empty history, got %+v (%v)", req.DR, resp, err)
+			}
+		})
+	}
+}
+
+func TestGetTrimmedMeanSNR(t *testing.T) {
+	tests := []struct {
+		name     string
+		history  []adr.UplinkMetaData
+		expected float32
+	}{
+		{"empty history", nil, -999},
+		{"identical values", testHistory(100, 20, -7, 3), -7},
+		{"high outlier", testOutlierHistory(20), -10},
+		{"low outlier", testOutlierHistory(-30), -10},
+		{"high and low outliers", testSNRHistory(-10, -10, -10, -10, -10, -10, -10, -10, -10, 20, -10, -10, -10, -10, -30, -10, -10, -10, -10, -10), -10},
+		// Below 10 samples, nothing is trimmed.
+		{"tiny history", testSNRHistory(-10, -10, 20, -10, -10), -4},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = tst.history
+
+			if snr := h.getTrimmedMeanSNR(req, 0.1); snr < tst.expected-0.0001 || snr > tst.expected+0.0001 {
+				t.Errorf("expected %v, got %v", tst.expected, snr)
+			}
+		})
+	}
+}
+
+func TestHandleTrimmedMeanSNR(t *testing.T) {
+	for strategy, expectedDR := range map[string]int{snrStrategyMax: 5, snrStrategyTrimmedMean: 2} {
+		h := testHandler(func(c *Config) {
+			c.SNRStrategy = strategy
+		})
+
+		// A single spike of +20 dB.
+		req := testRequest(-10)
+		req.UplinkHistory = testOutlierHistory(20)
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR != expectedDR {
+			t.Errorf("%s: expected DR%d, got DR%d", strategy, expectedDR, resp.DR)
+		}
+	}
+}
+
+func TestHandleSNRWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		window     int
+		expectedDR int
+	}{
+		{"complete history", 0, 4},
+		{"recent uplinks", 5, 2},
+		{"window larger than the history", 30, 4},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRWindow = tst.window
+			})
+
+			// 14 old uplinks with a margin of 6 dB (2 steps), 5 lost frames
+			// and 6 recent uplinks without margin.
+			req := testRequest(-10)
+			req.UplinkHistory = append(testHistory(100, 14, -4, 3), testHistory(119, 6, -10, 3)...)
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+
+			// The packet-loss uses the complete history.
+			if resp.NbTrans != 2 {
+				t.Errorf("expected NbTrans 2, got %d", resp.NbTrans)
+			}
+		})
+	}
+}
+
+func TestHandleAS923DwellTime(t *testing.T) {
+	tests := []struct {
+		name       string
+		region     string
+		dwellTime  bool
+		dr, maxDR  int
+		expectedDR int
+	}{
+		{"AS923, dwell time", "AS923", true, 4, 5, 2},
+		{"AS923-2, dwell time", "AS923-2", true, 4, 5, 2},
+		{"AS923, dwell time, DR below the floor", "AS923", true, 0, 5, 2},
+		{"AS923, dwell time, max. DR below the floor", "AS923", true, 1, 1, 0},
+		{"AS923, no dwell time", "AS923", false, 4, 5, 0},
+		{"EU868, dwell time", "EU868", true, 4, 5, 0},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.AS923DwellTime = tst.dwellTime
+			})
+
+			// A margin of -30 dB gives -10 steps.
+			req := testRequest(-40)
+			req.Region = tst.region
+			req.DR = tst.dr
+			req.MaxDR = tst.maxDR
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+}
+
+func TestHandleZeroMaxTxPowerIndex(t *testing.T) {
+	tests := []struct {
+		name     string
+		snr      float32
+		expected adr.HandleResponse
+	}{
+		{"no steps", -10, adr.HandleResponse{DR: 2, TxPowerIndex: 0, NbTrans: 1}},
+		{"positive steps", -4, adr.HandleResponse{DR: 4, TxPowerIndex: 0, NbTrans: 1}},
+		{"positive steps beyond the max. DR", 20, adr.HandleResponse{DR: 5, TxPowerIndex: 0, NbTrans: 1}},
+		{"negative steps", -16, adr.HandleResponse{DR: 0, TxPowerIndex: 0, NbTrans: 1}},
+	}
+
+	h := testHandler(nil)
+	hook := testLogHook(t)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(tst.snr)
+			req.TxPowerIndex = 0
+			req.MaxTxPowerIndex = 0
+			req.UplinkHistory = testHistory(100, 20, tst.snr, 0)
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+
+	// The warning is logged once.
+	var warnings int
+	for _, e := range hook.AllEntries() {
+		if e.Level == log.WarnLevel && e.Message == "Max. TxPowerIndex is 0, the TxPower is never decreased" {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("expected a single warning, got %d", warnings)
+	}
+}
+
+func TestHandleConcurrentReload(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "a.toml"), filepath.Join(dir, "b.toml")}
+	contents := []string{
+		"step_size = 3\npkt_loss_per_device = true\ncooldown_frames = 1\n",
+		"step_size = 6\npkt_loss_per_device = false\ncooldown_frames = 2\n",
+	}
+	for i, path := range paths {
+		if err := os.WriteFile(path, []byte(contents[i]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := testHandler(nil)
+	h.reloadConfig(paths[0], nil)
+
+	// Handle requests of multiple devices concurrently with the reloads, run
+	// with -race.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := testRequest(-4)
+			req.DevEUI = [8]byte{byte(i)}
+			for j := 0; j < 200; j++ {
+				req.UplinkHistory = testHistory(uint32(100+j), 20, float32(j%10-12), req.TxPowerIndex)
+
+				resp, err := h.Handle(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if resp.DR < req.MinDR || resp.DR > req.MaxDR || resp.TxPowerIndex < 0 || resp.TxPowerIndex > req.MaxTxPowerIndex {
+					t.Errorf("response out of range: %+v", resp)
+					return
+				}
+				req.DR, req.TxPowerIndex, req.NbTrans = resp.DR, resp.TxPowerIndex, resp.NbTrans
+			}
+		}(i)
+	}
+
+	for i := 0; i < 50; i++ {
+		h.reloadConfig(paths[i%2], nil)
+	}
+	wg.Wait()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.config.StepSize != 6 {
+		t.Errorf("expected step size 6 after the last reload, got %v", h.config.StepSize)
+	}
+}
+
+func BenchmarkHandleParallel(b *testing.B) {
+	h := testHandler(func(c *Config) {
+		c.PktLossPerDevice = true
+		c.CooldownFrames = 1
+	})
+
+	var devices uint32
+	b.RunParallel(func(pb *testing.PB) {
+		req := testRequest(-4)
+		req.DevEUI = [8]byte{byte(atomic.AddUint32(&devices, 1))}
+
+		for pb.Next() {
+			if _, err := h.Handle(req); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestGetNbTransThresholds(t *testing.T) {
+	h := testHandler(func(c *Config) {
+		c.PktLossThresholds = [3]float32{2, 4, 8}
+	})
+
+	// The second column of the table, for the current NbTrans 2.
+	tests := []struct {
+		pktLossRate float32
+		expected    int
+	}{
+		{0, 1},
+		{1.99, 1},
+		{2, 2},
+		{3.99, 2},
+		{4, 3},
+		{7.99, 3},
+		{8, 3},
+		{100, 3},
+	}
+
+	for _, tst := range tests {
+		if nbTrans := h.getNbTrans(2, tst.pktLossRate); nbTrans != tst.expected {
+			t.Errorf("packet-loss %v: expected NbTrans %d, got %d", tst.pktLossRate, tst.expected, nbTrans)
+		}
+	}
+}
+
+// testGatewayHistory returns 10 uplinks at an SNR of -4 received by a single
+// gateway and 10 uplinks at an SNR of -10 received by 6 gateways.
+func testGatewayHistory() []adr.UplinkMetaData {
+	history := append(testHistory(100, 10, -4, 3), testHistory(110, 10, -10, 3)...)
+	for i := 10; i < 20; i++ {
+		history[i].GatewayCount = 6
+	}
+	return history
+}
+
+func TestGetWeightedMeanSNR(t *testing.T) {
+	tests := []struct {
+		name       string
+		weighting  string
+		saturation int
+		expected   float32
+	}{
+		{"linear", gatewayWeightingLinear, 0, -9.1429},
+		{"sqrt", gatewayWeightingSqrt, 0, -8.2606},
+		{"log", gatewayWeightingLog, 0, -8.4176},
+		{"linear, saturated", gatewayWeightingLinear, 2, -8},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRGatewayWeighting = tst.weighting
+				c.SNRGatewaySaturation = tst.saturation
+			})
+			req := testRequest(-10)
+			req.UplinkHistory = testGatewayHistory()
+
+			if snr := h.getWeightedMeanSNR(req); snr < tst.expected-0.001 || snr > tst.expected+0.001 {
+				t.Errorf("expected %v, got %v", tst.expected, snr)
+			}
+		})
+	}
+
+	// Without gateway counts the plain mean is used.
+	h := testHandler(nil)
+	req := testRequest(-10)
+	req.UplinkHistory = testGatewayHistory()
+	for i := range req.UplinkHistory {
+		req.UplinkHistory[i].GatewayCount = 0
+	}
+	if snr := h.getWeightedMeanSNR(req); snr != -7 {
+		t.Errorf("expected the mean SNR of -7, got %v", snr)
+	}
+}
+
+func TestHandleWeightedMeanSNR(t *testing.T) {
+	// The unweighted mean margin of 3 dB gives a step, the weighted mean is
+	// dominated by the uplinks received by 6 gateways.
+	for strategy, expectedDR := range map[string]int{snrStrategyMean: 3, snrStrategyWeightedMean: 2} {
+		h := testHandler(func(c *Config) {
+			c.SNRStrategy = strategy
+		})
+		req := testRequest(-10)
+		req.UplinkHistory = testGatewayHistory()
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR != expectedDR {
+			t.Errorf("%s: expected DR%d, got DR%d", strategy, expectedDR, resp.DR)
+		}
+	}
+}
+
+func TestHandleSingleGatewayMargin(t *testing.T) {
+	tests := []struct {
+		name           string
+		singleGateways int // the number of uplinks received by a single gateway
+		gatewayCount   int // the gateway count of the other uplinks
+		expectedMargin float32
+		expectedDR     int
+	}{
+		{"1 gateway", 20, 0, 3, 3},
+		{"2 gateways", 0, 2, 0, 4},
+		{"mixed, median 1", 11, 2, 3, 3},
+		{"mixed, median between 1 and 2", 10, 2, 0, 4},
+		{"mixed, median 2", 9, 2, 0, 4},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SingleGatewayMargin = 3
+			})
+
+			// A margin of 6 dB without the single-gateway margin gives 2 steps.
+			req := testRequest(-4)
+			for i := tst.singleGateways; i < len(req.UplinkHistory); i++ {
+				req.UplinkHistory[i].GatewayCount = tst.gatewayCount
+			}
+
+			if margin := h.getSingleGatewayMargin(req); margin != tst.expectedMargin {
+				t.Errorf("expected a single-gateway margin of %v, got %v", tst.expectedMargin, margin)
+			}
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+}
+
+func TestHandlePoisonedHistory(t *testing.T) {
+	snrMin, snrMax := float32(-30), float32(20)
+	h := testHandler(func(c *Config) {
+		c.PlausibleSNRMin = &snrMin
+		c.PlausibleSNRMax = &snrMax
+		c.PlausibleGatewayCountMin = 1
+		c.RequiredHistoryCount = 10
+	})
+
+	tests := []struct {
+		name     string
+		fn       func(history []adr.UplinkMetaData)
+		expected adr.HandleResponse
+	}{
+		{
+			name:     "clean history",
+			fn:       func(history []adr.UplinkMetaData) {},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			// Without the check, the max. SNR gives 15 steps.
+			name: "SNR spike",
+			fn: func(history []adr.UplinkMetaData) {
+				history[5].MaxSNR = 35
+				history[15].MaxSNR = 35
+			},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name: "gateway count of 0",
+			fn: func(history []adr.UplinkMetaData) {
+				history[5].MaxSNR = 5
+				history[5].GatewayCount = 0
+			},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			// The discarded uplinks were received, they are not lost.
+			name: "uplinks discarded in between",
+			fn: func(history []adr.UplinkMetaData) {
+				for i := 5; i < 10; i++ {
+					history[i].MaxSNR = 35
+				}
+			},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+		{
+			name: "all uplinks discarded",
+			fn: func(history []adr.UplinkMetaData) {
+				for i := range history {
+					history[i].GatewayCount = 0
+				}
+			},
+			expected: adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			tst.fn(req.UplinkHistory)
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+
+	// The same applies to the packet-loss kept per device, the discarded
+	// uplinks are handled one by one.
+	h.config.PktLossPerDevice = true
+	req := testRequest(-10)
+	for _, m := range append(testHistory(120, 5, 35, 3), testHistory(125, 1, -10, 3)...) {
+		req.UplinkHistory = append(req.UplinkHistory[1:], m)
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.NbTrans != 1 {
+			t.Errorf("expected NbTrans 1, got %d", resp.NbTrans)
+		}
+	}
+	if h.devices.devices[req.DevEUI.String()].pktLoss == nil {
+		t.Fatal("expected the packet-loss state of the device")
+	}
+	if pktLossRate := h.getDevicePacketLossPercentage(req); pktLossRate != 0 {
+		t.Errorf("expected no packet-loss, got %v", pktLossRate)
+	}
+}
+
+func TestGetPacketLossPercentageGatewayWeighting(t *testing.T) {
+	tests := []struct {
+		name                 string
+		before, after        int // the gateway counts around the gap
+		unweighted, weighted float32
+	}{
+		// A gap of 2 frames: 17.1%, weighted as a single frame: 9%.
+		{"single gateway", 1, 1, 17.1, 9},
+		{"gateway count of 0", 0, 1, 17.1, 9},
+		{"multiple gateways", 3, 3, 17.1, 17.1},
+		{"single gateway before the gap", 1, 3, 17.1, 17.1},
+		{"single gateway after the gap", 3, 1, 17.1, 17.1},
+	}
+
+	unweighted := testHandler(nil)
+	weighted := testHandler(func(c *Config) {
+		c.PktLossGatewayWeighting = true
+	})
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = testFCntHistory(append(testFCntRange(100, 119), 121)...)
+			req.UplinkHistory[18].GatewayCount = tst.before
+			req.UplinkHistory[19].GatewayCount = tst.after
+
+			if pktLossRate := unweighted.getPacketLossPercentage(req); pktLossRate < tst.unweighted-0.001 || pktLossRate > tst.unweighted+0.001 {
+				t.Errorf("expected an unweighted packet-loss of %v, got %v", tst.unweighted, pktLossRate)
+			}
+			if pktLossRate := weighted.getPacketLossPercentage(req); pktLossRate < tst.weighted-0.001 || pktLossRate > tst.weighted+0.001 {
+				t.Errorf("expected a weighted packet-loss of %v, got %v", tst.weighted, pktLossRate)
+			}
+		})
+	}
+}
+
+func TestGetPacketLossPercentageOutOfOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		fCnts    []uint32
+		expected float32
+	}{
+		{"out-of-order at the end", append(testFCntRange(100, 119), 110), 0},
+		{"out-of-order in between", append(append(testFCntRange(100, 115), 105), testFCntRange(115, 119)...), 0},
+		// Only the gap of 2 frames from 117 to 120 counts: 17.1%.
+		{"out-of-order before a gap", append(append(testFCntRange(100, 118), 110), 120), 17.1},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = testFCntHistory(tst.fCnts...)
+
+			if pktLossRate := h.getPacketLossPercentage(req); pktLossRate < tst.expected-0.001 || pktLossRate > tst.expected+0.001 {
+				t.Errorf("expected a packet-loss of %v, got %v", tst.expected, pktLossRate)
+			}
+		})
+	}
+}
+
+func TestHandleMinSNR(t *testing.T) {
+	tests := []struct {
+		strategy   string
+		expectedDR int
+	}{
+		// The max. SNR margin is 6 dB (2 steps).
+		{snrStrategyMax, 4},
+		// The single fade gives a margin of -2 dB (no steps).
+		{snrStrategyMin, 2},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.strategy, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRStrategy = tst.strategy
+			})
+			req := testRequest(-4)
+			req.UplinkHistory[12].MaxSNR = -12
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+
+	h := testHandler(nil)
+	req := testRequest(-4)
+	req.UplinkHistory[12].MaxSNR = -12
+	if snr := h.getMinSNR(req); snr != -12 {
+		t.Errorf("expected a min. SNR of -12, got %v", snr)
+	}
+	if snr := h.getMinSNR(adr.HandleRequest{}); snr != -999 {
+		t.Errorf("expected -999 for an empty history, got %v", snr)
+	}
+
+	// An uplink without SNR is skipped.
+	req.UplinkHistory[5].MaxSNR = -999
+	if snr := h.getMinSNR(req); snr != -12 {
+		t.Errorf("expected a min. SNR of -12 with an uplink without SNR, got %v", snr)
+	}
+	req.UplinkHistory = testHistory(100, 20, -999, 3)
+	if snr := h.getMinSNR(req); snr != -999 {
+		t.Errorf("expected -999 without SNR, got %v", snr)
+	}
+
+	// Only the uplink without SNR: min. and max. keep the current values.
+	for _, strategy := range []string{snrStrategyMin, snrStrategyMax} {
+		h := testHandler(func(c *Config) {
+			c.SNRStrategy = strategy
+		})
+		req := testRequest(-10)
+		req.UplinkHistory[5].MaxSNR = -999
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1}); resp != expected {
+			t.Errorf("%s: expected %+v with an uplink without SNR, got %+v", strategy, expected, resp)
+		}
+	}
+}
+
+func TestLimitSteps(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxSteps, maxDown int
+		nStep, expected   int
+	}{
+		{"unlimited", 0, 0, -8, -8},
+		{"max. down steps", 0, 1, -8, -1},
+		{"max. down steps, positive steps", 0, 1, 8, 8},
+		{"max. down steps above the steps", 0, 10, -8, -8},
+		{"max. steps below the max. down steps", 2, 3, -8, -2},
+		{"max. down steps below the max. steps", 3, 1, -8, -1},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.MaxStepsPerCall = tst.maxSteps
+				c.MaxDownSteps = tst.maxDown
+			})
+			if nStep := h.limitSteps(tst.nStep); nStep != tst.expected {
+				t.Errorf("expected %d steps, got %d", tst.expected, nStep)
+			}
+		})
+	}
+}
+
+func TestHandleMaxDownSteps(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxDown  int
+		snr      float32
+		expected adr.HandleResponse
+	}{
+		{"limited, negative steps", 1, -25, adr.HandleResponse{DR: 2, TxPowerIndex: 2, NbTrans: 1}},
+		{"limited, positive steps", 1, 5, adr.HandleResponse{DR: 7, TxPowerIndex: 3, NbTrans: 1}},
+		{"limited to 2 negative steps", 2, -25, adr.HandleResponse{DR: 2, TxPowerIndex: 1, NbTrans: 1}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.MaxDownSteps = tst.maxDown
+			})
+
+			// A margin of 15 or -15 dB gives 5 or -5 steps.
+			req := testRequest(tst.snr)
+			req.MaxDR = 15
+			req.MaxTxPowerIndex = 15
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+}
+
+func TestGetRecencyWeightedSNR(t *testing.T) {
+	h := testHandler(nil)
+
+	// The link degraded halfway through the history, the mean SNR is -10.
+	req := testRequest(-10)
+	req.UplinkHistory = append(testHistory(100, 10, -4, 3), testHistory(110, 10, -16, 3)...)
+	if snr := h.getRecencyWeightedSNR(req, 0.2); snr < -12.11 || snr > -12.1 {
+		t.Errorf("expected a recency-weighted SNR of -12.105 (closer to the recent -16 than the mean -10), got %v", snr)
+	}
+	if snr := h.getRecencyWeightedSNR(req, 1); snr < -10.0001 || snr > -9.9999 {
+		t.Errorf("expected the mean SNR of -10 with a floor of 1, got %v", snr)
+	}
+
+	// Uplinks with the same frame-counter get the same weight, in any order.
+	req.UplinkHistory = testSNRHistory(-10, -4, -1)
+	req.UplinkHistory[1].FCnt = req.UplinkHistory[0].FCnt
+	snr := h.getRecencyWeightedSNR(req, 0.2)
+	if snr < -2.7143 || snr > -2.7142 {
+		t.Errorf("expected a recency-weighted SNR of -2.714, got %v", snr)
+	}
+	req.UplinkHistory[0].MaxSNR, req.UplinkHistory[1].MaxSNR = req.UplinkHistory[1].MaxSNR, req.UplinkHistory[0].MaxSNR
+	if swapped := h.getRecencyWeightedSNR(req, 0.2); swapped != snr {
+		t.Errorf("expected %v for the swapped uplinks, got %v", snr, swapped)
+	}
+
+	// Fewer than 3 uplinks, or uplinks which all share their frame-counter,
+	// give the mean SNR.
+	req.UplinkHistory = testSNRHistory(-10, -4)
+	if snr := h.getRecencyWeightedSNR(req, 0.2); snr != -7 {
+		t.Errorf("expected the mean SNR of -7 for 2 uplinks, got %v", snr)
+	}
+	req.UplinkHistory = testFCntHistory(100, 100, 100)
+	req.UplinkHistory[2].MaxSNR = -4
+	if snr := h.getRecencyWeightedSNR(req, 0.2); snr != -8 {
+		t.Errorf("expected the mean SNR of -8 for a single frame-counter, got %v", snr)
+	}
+}
+
+func TestDiscardSNROutliers(t *testing.T) {
+	tests := []struct {
+		name     string
+		sigma    float64
+		history  []adr.UplinkMetaData
+		expected int
+	}{
+		// The mean SNR is -11 with a standard deviation of 4.36 dB, the
+		// limit at 2 sigma is -19.7 dB.
+		{"disabled", 0, testOutlierHistory(-30), 20},
+		{"outlier", 2, testOutlierHistory(-30), 19},
+		{"outlier within the limit", 5, testOutlierHistory(-30), 20},
+		{"high outlier", 2, testOutlierHistory(8), 20},
+		{"uplinks without SNR are kept", 2, testSNRHistory(-10, -10, -10, -999), 4},
+		{"single uplink", 2, testSNRHistory(-30), 1},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNROutlierSigma = tst.sigma
+			})
+			req := testRequest(-10)
+			req.UplinkHistory = tst.history
+
+			if history := h.discardSNROutliers(req); len(history) != tst.expected {
+				t.Errorf("expected %d uplinks, got %d", tst.expected, len(history))
+			}
+		})
+	}
+}
+
+func TestHandleSNROutlierSigma(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategy   string
+		sigma      float64
+		expectedDR int
+	}{
+		// The fade gives a margin of -20 dB, without it the margin is 6 dB
+		// (2 steps).
+		{"min, disabled", snrStrategyMin, 0, 0},
+		{"min", snrStrategyMin, 2, 4},
+		{"mean, disabled", snrStrategyMean, 0, 3},
+		{"mean", snrStrategyMean, 2, 4},
+		{"max", snrStrategyMax, 2, 4},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRStrategy = tst.strategy
+				c.SNROutlierSigma = tst.sigma
+			})
+			req := testRequest(-4)
+			req.UplinkHistory[12].MaxSNR = -30
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+}
+
+func TestGetEWMASNR(t *testing.T) {
+	tests := []struct {
+		name     string
+		snrs     []float32
+		alpha    float32
+		expected float32
+	}{
+		{"empty history", nil, 0.5, -999},
+		{"single entry", []float32{-7}, 0.5, -7},
+		{"recent bad uplink", []float32{0, 0, 0, -8}, 0.5, -4},
+		{"old bad uplink", []float32{-8, 0, 0, 0}, 0.5, -1},
+		{"alpha 1, newest uplink only", []float32{-8, 0, 0, -2}, 1, -2},
+		{"alpha 0, oldest uplink only", []float32{-8, 0, 0, -2}, 0, -8},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = testSNRHistory(tst.snrs...)
+
+			if snr := h.getEWMASNR(req, tst.alpha); snr < tst.expected-0.0001 || snr > tst.expected+0.0001 {
+				t.Errorf("expected %v, got %v", tst.expected, snr)
+			}
+		})
+	}
+
+	t.Run("ordered by frame-counter", func(t *testing.T) {
+		req := testRequest(-10)
+		req.UplinkHistory = testSNRHistory(-8, 0, 0, 0)
+		req.UplinkHistory[0], req.UplinkHistory[3] = req.UplinkHistory[3], req.UplinkHistory[0]
+
+		req.UplinkHistory = h.normalizeHistory(req)
+		if snr := h.getEWMASNR(req, 0.5); snr != -1 {
+			t.Errorf("expected -1 for the normalized history, got %v", snr)
+		}
+	})
+
+	t.Run("recent degradation", func(t *testing.T) {
+		// The last 5 uplinks degraded by 12 dB: -16 + 12 * 0.7^5.
+		req := testRequest(-10)
+		req.UplinkHistory = append(testHistory(100, 15, -4, 3), testHistory(115, 5, -16, 3)...)
+
+		if snr := h.getEWMASNR(req, 0.3); snr < -13.99 || snr > -13.98 {
+			t.Errorf("expected an EWMA SNR of -13.98, got %v", snr)
+		}
+		if snr := h.getMaxSNR(req); snr != -4 {
+			t.Errorf("expected a max. SNR of -4, got %v", snr)
+		}
+	})
+}
+
+func TestGetSNRWithoutSNR(t *testing.T) {
+	strategies := append([]string{"p90"}, snrStrategies...)
+
+	for _, strategy := range strategies {
+		t.Run(strategy, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRStrategy = strategy
+			})
+			req := testRequest(-10)
+			req.UplinkHistory[5].MaxSNR = -999
+
+			if snr := h.getSNR(req); snr < -10.0001 || snr > -9.9999 {
+				t.Errorf("expected an SNR of -10 without the uplink without SNR, got %v", snr)
+			}
+
+			// Without any SNR, the strategies return -999.
+			req.UplinkHistory = testHistory(100, 20, -999, 3)
+			if snr := h.getSNR(req); snr != -999 {
+				t.Errorf("expected -999 without SNR, got %v", snr)
+			}
+		})
+	}
+}
+
+func TestHandleRequiredSNR(t *testing.T) {
+	tests := []struct {
+		name        string
+		requiredSNR map[string]float32
+		snr         float32
+		dr          int
+	}{
+		{"unset uses the request value", nil, -20, 2},
+		// A margin of 6 dB gives 2 steps.
+		{"set replaces the request value", map[string]float32{"2": -26}, -26, 4},
+		{"DR missing uses the request value", map[string]float32{"3": -26}, -20, 2},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.RequiredSNR = tst.requiredSNR
+			})
+			req := testRequest(-10)
+
+			if snr := h.getRequiredSNR(req); snr != tst.snr {
+				t.Errorf("expected required SNR %v, got %v", tst.snr, snr)
+			}
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.dr {
+				t.Errorf("expected DR %d, got %d", tst.dr, resp.DR)
+			}
+		})
+	}
+
+	t.Run("DR missing logs a warning", func(t *testing.T) {
+		hook := testLogHook(t)
+		config := defaultConfig()
+		config.RequiredSNR = map[string]float32{"3": -26}
+		config.sanitize()
+
+		var warnings int
+		for _, e := range hook.AllEntries() {
+			if e.Level == log.WarnLevel && e.Message == "DR is missing in required_snr, using the network-server required SNR" {
+				warnings++
+			}
+		}
+		if warnings != 15 {
+			t.Errorf("expected a warning per missing DR (15), got %d", warnings)
+		}
+	})
+}
+
+func TestGetMarginSNRSaturation(t *testing.T) {
+	saturation := float32(5)
+
+	tests := []struct {
+		name       string
+		saturation *float32
+		snr        float32
+		rssi       int32
+		expected   float32
+	}{
+		// The RSSI margin is -105 + 120 - 10 = 5 dB.
+		{"saturated uses the RSSI", &saturation, 8, -105, 5},
+		{"at the saturation uses the RSSI", &saturation, 5, -105, 5},
+		{"unsaturated uses the SNR", &saturation, 2, -105, 12},
+		{"saturated without RSSI uses the SNR", &saturation, 8, 0, 18},
+		{"unset uses the SNR", nil, 8, -105, 18},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRSaturation = tst.saturation
+			})
+			req := testRequest(tst.snr)
+			for i := range req.UplinkHistory {
+				req.UplinkHistory[i].MaxRSSI = tst.rssi
+			}
+
+			if margin := h.getMargin(req); margin != tst.expected {
+				t.Errorf("expected a margin of %v, got %v", tst.expected, margin)
+			}
+		})
+	}
+}
+
+func TestHandleDryRun(t *testing.T) {
+	h := testHandler(func(c *Config) {
+		c.DryRun = true
+		c.CooldownFrames = 5
+	})
+
+	// A margin of 6 dB gives 2 steps, which are not applied.
+	req := testRequest(-4)
+	drIncreases := testutil.ToFloat64(drIncreaseCounter)
+	requests := testutil.ToFloat64(requestCounter)
+
+	for i := 0; i < 3; i++ {
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1}); resp != expected {
+			t.Errorf("expected %+v, got %+v", expected, resp)
+		}
+	}
+
+	if d := testutil.ToFloat64(drIncreaseCounter) - drIncreases; d != 0 {
+		t.Errorf("expected no DR increases in the metrics, got %v", d)
+	}
+	if d := testutil.ToFloat64(requestCounter) - requests; d != 3 {
+		t.Errorf("expected 3 requests in the metrics, got %v", d)
+	}
+	if h.inCooldown(req) {
+		t.Error("expected no cooldown in dry-run mode")
+	}
+}
+
+func TestHandlePktLossPerDeviceCooldown(t *testing.T) {
+	h := testHandler(func(c *Config) {
+		c.PktLossPerDevice = true
+		c.CooldownFrames = 5
+	})
+
+	// Without any loss, the uplinks received during the cooldown must not
+	// be counted as lost.
+	req := testRequest(-4)
+	for i := 0; i < 30; i++ {
+		req.UplinkHistory = testHistory(100+uint32(i), 20, -4, req.TxPowerIndex)
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.NbTrans != 1 {
+			t.Fatalf("expected NbTrans 1 at request %d, got %d", i, resp.NbTrans)
+		}
+		req.DR, req.TxPowerIndex, req.NbTrans = resp.DR, resp.TxPowerIndex, resp.NbTrans
+	}
+
+	state := h.devices.devices[req.DevEUI.String()].pktLoss
+	if state == nil {
+		t.Fatal("expected the packet-loss state of the device")
+	}
+	if state.ema != 0 || state.fCnt != 148 {
+		t.Errorf("expected no packet-loss up to FCnt 148, got %v up to FCnt %d", state.ema, state.fCnt)
+	}
+}
+
+func TestHandleDisableNbTrans(t *testing.T) {
+	tests := []struct {
+		name     string
+		disable  bool
+		nbTrans  int
+		expected adr.HandleResponse
+	}{
+		// Every other frame is lost, the margin of 6 dB gives 2 steps.
+		{"enabled", false, 1, adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 3}},
+		{"disabled", true, 1, adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 1}},
+		{"disabled, NbTrans 2", true, 2, adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 2}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.DisableNbTrans = tst.disable
+			})
+			req := testRequest(-4)
+			req.NbTrans = tst.nbTrans
+			req.UplinkHistory = testFCntHistory(testEveryOtherLost(20)...)
+			for i := range req.UplinkHistory {
+				req.UplinkHistory[i].MaxSNR = -4
+			}
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+		})
+	}
+}
+
+func TestHandleConfigMinDR(t *testing.T) {
+	tests := []struct {
+		name       string
+		minDR      int
+		maxDR      int
+		snr        float32
+		expectedDR int
+	}{
+		// A margin of -20 dB gives -6 steps, 6 dB gives 2 steps.
+		{"negative steps stop at the min. DR", 1, 5, -30, 1},
+		{"min. DR at the current DR", 2, 5, -30, 2},
+		{"min. DR above the max. DR", 5, 3, -30, 2},
+		{"positive steps stop at the max. DR", 2, 3, -4, 3},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.MinDR = tst.minDR
+			})
+			req := testRequest(tst.snr)
+			req.MaxDR = tst.maxDR
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+}
+
+func TestGetIdealTxPowerIndexAndDRMinLimits(t *testing.T) {
+	tests := []struct {
+		name                 string
+		nStep                int
+		txPowerIndex, dr     int
+		minTxPowerIndex      int
+		minDR                int
+		expectedTxPowerIndex int
+		expectedDR           int
+	}{
+		{"extreme negative steps", -1000, 7, 5, 2, 1, 2, 1},
+		{"extreme negative steps, min. TxPowerIndex only", -1000, 7, 5, 4, 0, 4, 0},
+		{"extreme negative steps, min. DR only", -1000, 7, 5, 1, 3, 1, 3},
+		{"extreme negative steps at the limits", -1000, 2, 1, 2, 1, 2, 1},
+		{"extreme negative steps at the max. limits", -1000, 7, 5, 7, 5, 7, 5},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			txPowerIndex, dr := h.getIdealTxPowerIndexAndDR(tst.nStep, tst.txPowerIndex, tst.dr, tst.minTxPowerIndex, 7, tst.minDR, 5, true)
+			if txPowerIndex != tst.expectedTxPowerIndex || dr != tst.expectedDR {
+				t.Errorf("expected TxPowerIndex %d and DR%d, got %d and DR%d", tst.expectedTxPowerIndex, tst.expectedDR, txPowerIndex, dr)
+			}
+		})
+	}
+}
+
+func TestGetInstallationMarginRegion(t *testing.T) {
+	override := float32(4)
+	max := float32(8)
+	regions := map[string]float32{"EU868": 2, "US915": -3}
+
+	tests := []struct {
+		name     string
+		region   string
+		regions  map[string]float32
+		override *float32
+		max      *float32
+		expected float32
+	}{
+		{"no regions", "EU868", nil, nil, nil, 10},
+		{"EU868", "EU868", regions, nil, nil, 12},
+		{"US915", "US915", regions, nil, nil, 7},
+		{"unknown region uses the request value", "AS923", regions, nil, nil, 10},
+		{"no region uses the request value", "", regions, nil, nil, 10},
+		{"added to the clamped request value", "EU868", regions, nil, &max, 10},
+		{"override takes precedence", "EU868", regions, &override, nil, 4},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.RegionInstallationMargin = tst.regions
+				c.InstallationMarginOverride = tst.override
+				c.InstallationMarginMax = tst.max
+			})
+			req := testRequest(-10)
+			req.Region = tst.region
+
+			if margin := h.getInstallationMargin(req); margin != tst.expected {
+				t.Errorf("expected installation margin %v, got %v", tst.expected, margin)
+			}
+		})
+	}
+
+	// The margin of -3 dB gives 1 step in US915 only.
+	h := testHandler(func(c *Config) {
+		c.RegionInstallationMargin = regions
+	})
+	for region, expectedDR := range map[string]int{"US915": 3, "EU868": 2, "AS923": 2} {
+		req := testRequest(-10)
+		req.Region = region
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR != expectedDR {
+			t.Errorf("%s: expected DR%d, got DR%d", region, expectedDR, resp.DR)
+		}
+	}
+}
+
+func TestGetStepSize(t *testing.T) {
+	tests := []struct {
+		region   string
+		stepSize float32
+		expected float32
+	}{
+		{"EU868", 3, 3},
+		{"US915", 3, 2.5},
+		{"AU915", 3, 2.5},
+		{"AS923", 3, 3},
+		{"", 3, 3},
+		{"unknown region uses step_size", 4, 4},
+		{"US915", 4, 2.5},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.region, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.StepSize = tst.stepSize
+			})
+			req := testRequest(-10)
+			req.Region = tst.region
+
+			if size := h.getStepSize(req); size != tst.expected {
+				t.Errorf("expected a step size of %v, got %v", tst.expected, size)
+			}
+		})
+	}
+
+	// A margin of 5 dB gives 2 steps of 2.5 dB in US915, 1 step of 3 dB in
+	// EU868.
+	h := testHandler(nil)
+	for region, expectedDR := range map[string]int{"US915": 4, "EU868": 3} {
+		req := testRequest(-5)
+		req.Region = region
+
+		resp, err := h.Handle(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.DR != expectedDR {
+			t.Errorf("%s: expected DR%d, got DR%d", region, expectedDR, resp.DR)
+		}
+	}
+}
+
+func TestHandleEWMASNR(t *testing.T) {
+	recent := append(testHistory(100, 17, -4, 3), testHistory(117, 3, -16, 3)...)
+	old := append(testHistory(100, 3, -16, 3), testHistory(103, 17, -4, 3)...)
+
+	tests := []struct {
+		name       string
+		strategy   string
+		history    []adr.UplinkMetaData
+		expectedDR int
+	}{
+		// The max. SNR margin is 6 dB (2 steps).
+		{"max, recent bad uplinks", snrStrategyMax, recent, 4},
+		// -16 + 12 * 0.7^3 gives a margin of -1.9 dB (no steps).
+		{"ewma, recent bad uplinks", snrStrategyEWMA, recent, 2},
+		// The old bad uplinks have decayed, the margin is just below 6 dB
+		// (1 step).
+		{"ewma, old bad uplinks", snrStrategyEWMA, old, 3},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.SNRStrategy = tst.strategy
+			})
+			req := testRequest(-10)
+			req.UplinkHistory = tst.history
+
+			resp, err := h.Handle(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.DR != tst.expectedDR {
+				t.Errorf("expected DR%d, got DR%d", tst.expectedDR, resp.DR)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-network-server/v3/adr"
+)
+
+// metricsNamespace is the namespace of the Prometheus metrics.
+const metricsNamespace = "alitecs_adr"
+
+var (
+	requestCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "The number of handled ADR requests.",
+	})
+
+	drIncreaseCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dr_increase_total",
+		Help:      "The number of DR increases.",
+	})
+
+	drDecreaseCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dr_decrease_total",
+		Help:      "The number of DR decreases.",
+	})
+
+	txPowerIncreaseCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tx_power_increase_total",
+		Help:      "The number of TxPower increases (TxPowerIndex decreases).",
+	})
+
+	txPowerDecreaseCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tx_power_decrease_total",
+		Help:      "The number of TxPower decreases (TxPowerIndex increases).",
+	})
+
+	nbTransChangeCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "nb_trans_change_total",
+		Help:      "The number of NbTrans changes.",
+	})
+
+	nStepHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "nstep",
+		Help:      "The calculated number of DR / TxPower steps.",
+		Buckets:   prometheus.LinearBuckets(-10, 1, 21),
+	})
+
+	snrMarginHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "snr_margin_db",
+		Help:      "The calculated SNR margin (dB).",
+		Buckets:   prometheus.LinearBuckets(-30, 3, 21),
+	})
+)
+
+// recordMetrics records the changes of the response compared to the request.
+func recordMetrics(req adr.HandleRequest, resp adr.HandleResponse) {
+	requestCounter.Inc()
+
+	if resp.DR > req.DR {
+		drIncreaseCounter.Inc()
+	} else if resp.DR < req.DR {
+		drDecreaseCounter.Inc()
+	}
+
+	if resp.TxPowerIndex < req.TxPowerIndex {
+		txPowerIncreaseCounter.Inc()
+	} else if resp.TxPowerIndex > req.TxPowerIndex {
+		txPowerDecreaseCounter.Inc()
+	}
+
+	if resp.NbTrans != req.NbTrans {
+		nbTransChangeCounter.Inc()
+	}
+}
+
+// startMetricsServer starts serving the Prometheus metrics on the given
+// address under /metrics.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	log.WithField("addr", addr).Info("Starting metrics server")
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.WithError(err).Error("Metrics server error")
+		}
+	}()
+}
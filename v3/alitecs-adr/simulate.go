@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/brocaar/chirpstack-network-server/v3/adr"
+)
+
+// simulate handles the JSON encoded request read from r and writes the JSON
+// encoded response to w, using the same logic as Handle but without the
+// plugin RPC layer. This allows to replay recorded uplink histories offline.
+func (h *Handler) simulate(r io.Reader, w io.Writer) error {
+	var req adr.HandleRequest
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return fmt.Errorf("decode request error: %w", err)
+	}
+
+	resp, err := h.Handle(req)
+	if err != nil {
+		return fmt.Errorf("handle request error: %w", err)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		return fmt.Errorf("encode response error: %w", err)
+	}
+
+	return nil
+}
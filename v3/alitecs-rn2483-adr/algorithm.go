@@ -0,0 +1,118 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-network-server/v3/adr"
+)
+
+// Algorithms, see Config.Algorithm.
+const (
+	algorithmALITECS = "alitecs"
+	algorithmLoRa    = "lora"
+)
+
+// algorithms contains all valid algorithms.
+var algorithms = []string{
+	algorithmALITECS,
+	algorithmLoRa,
+}
+
+// algorithm calculates the new DR, TxPower and NbTrans of a device.
+type algorithm interface {
+	// handle returns the new values, the reasons which keep the current
+	// values are added to fields.
+	handle(req adr.HandleRequest, fields log.Fields) (adr.HandleResponse, error)
+}
+
+// getAlgorithm returns the configured algorithm.
+func (h *Handler) getAlgorithm() algorithm {
+	if h.config.Algorithm == algorithmLoRa {
+		return loraAlgorithm{defaults: loraDefaults}
+	}
+	return alitecsAlgorithm{h: h}
+}
+
+// alitecsAlgorithm is the ALITECS algorithm, using the configuration of the
+// handler.
+type alitecsAlgorithm struct {
+	h *Handler
+}
+
+func (a alitecsAlgorithm) handle(req adr.HandleRequest, fields log.Fields) (adr.HandleResponse, error) {
+	return a.h.handle(req, fields)
+}
+
+// loraDefaults is the handler with the default configuration which is used
+// by the lora algorithm.
+var loraDefaults = &Handler{config: defaultConfig()}
+
+// loraAlgorithm is the textbook LoRaWAN ADR algorithm: the max. SNR of the
+// full uplink history minus the required SNR and the installation margin of
+// the network server gives the number of steps, NbTrans follows the ratio of
+// lost frames. It ignores the configuration.
+type loraAlgorithm struct {
+	defaults *Handler
+}
+
+func (a loraAlgorithm) handle(req adr.HandleRequest, fields log.Fields) (adr.HandleResponse, error) {
+	h := a.defaults
+	resp := adr.HandleResponse{
+		DR:           req.DR,
+		TxPowerIndex: req.TxPowerIndex,
+		NbTrans:      req.NbTrans,
+	}
+
+	if !req.ADR {
+		fields["reason"] = []adjustmentReason{reasonADRDisabled}
+		return resp, nil
+	}
+
+	req.UplinkHistory = h.normalizeHistory(req)
+	if req.DR > req.MaxDR {
+		resp.DR = req.MaxDR
+	}
+	if resp.DR < req.MinDR {
+		resp.DR = req.MinDR
+	}
+	if resp.TxPowerIndex > req.MaxTxPowerIndex {
+		resp.TxPowerIndex = req.MaxTxPowerIndex
+	}
+
+	if len(req.UplinkHistory) < h.requiredHistoryCount() || !hasSNR(req) {
+		fields["reason"] = []adjustmentReason{reasonInsufficientHistory}
+		return resp, nil
+	}
+
+	pktLossRate := a.getPacketLossPercentage(req)
+	fields["pkt_loss_rate"] = pktLossRate
+	resp.NbTrans = h.getNbTrans(req.NbTrans, pktLossRate)
+
+	snrMargin := h.getMaxSNR(req) - req.RequiredSNRForDR - req.InstallationMargin
+	nStep := int(snrMargin / h.config.StepSize)
+	fields["snr_margin"] = snrMargin
+	fields["n_step"] = nStep
+
+	resp.TxPowerIndex, resp.DR = h.getIdealTxPowerIndexAndDR(nStep, resp.TxPowerIndex, resp.DR, h.config.MinTxPowerIndex, req.MaxTxPowerIndex, req.MinDR, req.MaxDR, true)
+
+	return resp, nil
+}
+
+// getPacketLossPercentage returns the ratio (%) of the lost to the expected
+// frames of the uplink history, all frames weighted equally. A reset of the
+// frame-counter is not counted as lost frames.
+func (a loraAlgorithm) getPacketLossPercentage(req adr.HandleRequest) float32 {
+	if len(req.UplinkHistory) == 0 {
+		return 0
+	}
+
+	var lost uint32
+	expected := uint32(1) // the first uplink
+	for i := 1; i < len(req.UplinkHistory); i++ {
+		gap, _ := a.defaults.getFCntGap(req.UplinkHistory[i-1].FCnt, req.UplinkHistory[i].FCnt, req.MACVersion)
+		lost += gap
+		expected += gap + 1
+	}
+
+	return float32(lost) / float32(expected) * 100
+}
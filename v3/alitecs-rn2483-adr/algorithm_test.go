@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/brocaar/chirpstack-network-server/v3/adr"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestHandlerAlgorithm(t *testing.T) {
+	tests := []struct {
+		algorithm    string
+		expectedID   string
+		expectedName string
+	}{
+		{algorithmALITECS, "alitecs-rn2483-adr", "ALITECS RN2483 ADR algorithm (" + version + ")"},
+		{algorithmLoRa, "alitecs-rn2483-adr-lora", "ALITECS RN2483 ADR algorithm, LoRa textbook (" + version + ")"},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.algorithm, func(t *testing.T) {
+			h := testHandler(func(c *Config) {
+				c.Algorithm = tst.algorithm
+			})
+
+			if id, err := h.ID(); err != nil || id != tst.expectedID {
+				t.Errorf("expected ID %s, got %q (%v)", tst.expectedID, id, err)
+			}
+			if name, err := h.Name(); err != nil || name != tst.expectedName {
+				t.Errorf("expected name %q, got %q (%v)", tst.expectedName, name, err)
+			}
+
+			switch a := h.getAlgorithm().(type) {
+			case alitecsAlgorithm:
+				if tst.algorithm != algorithmALITECS {
+					t.Errorf("expected the %s algorithm, got %T", tst.algorithm, a)
+				}
+			case loraAlgorithm:
+				if tst.algorithm != algorithmLoRa {
+					t.Errorf("expected the %s algorithm, got %T", tst.algorithm, a)
+				}
+			}
+		})
+	}
+}
+
+func TestLoRaAlgorithmPacketLoss(t *testing.T) {
+	tests := []struct {
+		name     string
+		fCnts    []uint32
+		expected float32
+	}{
+		{"empty history", nil, 0},
+		{"no loss", testFCntRange(100, 120), 0},
+		// 5 of the expected frames 100 - 124 are lost.
+		{"old burst", append([]uint32{100}, testFCntRange(106, 125)...), 20},
+		{"recent burst", append(testFCntRange(100, 119), 124), 20},
+		{"rollover", testFCntRange(65530, 65550), 0},
+		{"reset", append(testFCntRange(1000, 1010), testFCntRange(0, 10)...), 0},
+	}
+
+	a := loraAlgorithm{defaults: loraDefaults}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-10)
+			req.UplinkHistory = testFCntHistory(tst.fCnts...)
+
+			if pktLossRate := a.getPacketLossPercentage(req); pktLossRate < tst.expected-0.001 || pktLossRate > tst.expected+0.001 {
+				t.Errorf("expected a packet-loss of %v, got %v", tst.expected, pktLossRate)
+			}
+		})
+	}
+}
+
+func TestHandleLoRaAlgorithm(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       func(req *adr.HandleRequest)
+		expected adr.HandleResponse
+		reason   adjustmentReason
+	}{
+		// A margin of 6 dB gives 2 steps.
+		{"steps", func(req *adr.HandleRequest) {}, adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 1}, ""},
+		{"ADR disabled", func(req *adr.HandleRequest) { req.ADR = false }, adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1}, reasonADRDisabled},
+		{"insufficient history", func(req *adr.HandleRequest) { req.UplinkHistory = req.UplinkHistory[:19] }, adr.HandleResponse{DR: 2, TxPowerIndex: 3, NbTrans: 1}, reasonInsufficientHistory},
+		// 20% of the frames are lost (row 2), regardless of the age of the
+		// burst.
+		{"old burst", func(req *adr.HandleRequest) {
+			req.UplinkHistory = testFCntHistory(append([]uint32{100}, testFCntRange(106, 125)...)...)
+			for i := range req.UplinkHistory {
+				req.UplinkHistory[i].MaxSNR = -4
+			}
+		}, adr.HandleResponse{DR: 4, TxPowerIndex: 3, NbTrans: 2}, ""},
+	}
+
+	// The configuration is ignored.
+	h := testHandler(func(c *Config) {
+		c.Algorithm = algorithmLoRa
+		c.StepSize = 1
+		c.DisableNbTrans = true
+	})
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			req := testRequest(-4)
+			tst.fn(&req)
+
+			fields := log.Fields{}
+			resp, err := h.getAlgorithm().handle(req, fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp != tst.expected {
+				t.Errorf("expected %+v, got %+v", tst.expected, resp)
+			}
+
+			reasons, _ := fields["reason"].([]adjustmentReason)
+			if tst.reason != "" && (len(reasons) != 1 || reasons[0] != tst.reason) {
+				t.Errorf("expected reason %s, got %v", tst.reason, reasons)
+			}
+		})
+	}
+
+	// The ALITECS algorithm applies the EMA, in which the old burst has
+	// decayed.
+	req := testRequest(-4)
+	req.UplinkHistory = testFCntHistory(append([]uint32{100}, testFCntRange(106, 125)...)...)
+	if pktLossRate := testHandler(nil).getPacketLossPercentage(req); pktLossRate >= 10 {
+		t.Errorf("expected an EMA packet-loss below 10%%, got %v", pktLossRate)
+	}
+}
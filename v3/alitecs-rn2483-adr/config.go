@@ -0,0 +1,1741 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+)
+
+// SNR strategies, see Config.SNRStrategy.
+const (
+	snrStrategyMax          = "max"
+	snrStrategyMin          = "min"
+	snrStrategyMedian       = "median"
+	snrStrategyPercentile   = "percentile"
+	snrStrategyEWMA         = "ewma"
+	snrStrategyMean         = "mean"
+	snrStrategyAvg          = "avg" // Alias of snrStrategyMean.
+	snrStrategyWeightedMean = "weighted-mean"
+	snrStrategyTrimmedMean  = "trimmed-mean"
+	snrStrategyRecency      = "recency-weighted"
+)
+
+// snrStrategies contains all valid SNR strategies.
+var snrStrategies = []string{
+	snrStrategyMax,
+	snrStrategyMin,
+	snrStrategyMedian,
+	snrStrategyPercentile,
+	snrStrategyEWMA,
+	snrStrategyMean,
+	snrStrategyAvg,
+	snrStrategyWeightedMean,
+	snrStrategyTrimmedMean,
+	snrStrategyRecency,
+}
+
+// Gateway weightings, see Config.SNRGatewayWeighting.
+const (
+	gatewayWeightingLinear = "linear"
+	gatewayWeightingSqrt   = "sqrt"
+	gatewayWeightingLog    = "log"
+)
+
+// gatewayWeightings contains all valid gateway weightings.
+var gatewayWeightings = []string{
+	gatewayWeightingLinear,
+	gatewayWeightingSqrt,
+	gatewayWeightingLog,
+}
+
+// Modes, see Config.Mode.
+const (
+	modeSymmetric    = "symmetric"
+	modeConservative = "conservative"
+)
+
+// modes contains all valid modes.
+var modes = []string{
+	modeSymmetric,
+	modeConservative,
+}
+
+// envPrefix is the prefix of the environment variables overriding the
+// configuration.
+const envPrefix = "ALITECS_ADR_"
+
+// Config holds the tunables of the ADR algorithm.
+type Config struct {
+	// Algorithm defines the ADR algorithm: alitecs or lora, the textbook
+	// LoRaWAN algorithm which ignores the other settings.
+	Algorithm string `toml:"algorithm" json:"algorithm"`
+
+	// StepSize defines the SNR margin (dB) which equals a single DR or
+	// TxPower step.
+	StepSize float32 `toml:"step_size" json:"step_size"`
+
+	// RequiredHistoryCount defines the number of uplink history elements
+	// that are needed before the DR, TxPower or NbTrans is changed.
+	RequiredHistoryCount int `toml:"required_history_count" json:"required_history_count"`
+
+	// QuickStartMinFrames defines the min. number of uplink history elements
+	// without any lost frame and with a strong SNR, which are needed to
+	// increase the DR or decrease the TxPower before the RequiredHistoryCount
+	// is reached. 0 disables the quick start.
+	QuickStartMinFrames int `toml:"quick_start_min_frames" json:"quick_start_min_frames"`
+
+	// PktLossThresholds defines the packet-loss (%) upper bounds of the first
+	// three rows of the PktLossRateTable. Packet-loss above the last
+	// threshold selects the fourth row.
+	PktLossThresholds [3]float32 `toml:"pkt_loss_thresholds" json:"pkt_loss_thresholds"`
+
+	// PktLossRateTable defines the new NbTrans (1 - 15), per packet-loss row
+	// (see PktLossThresholds) and current NbTrans (column 1 - 3).
+	PktLossRateTable [4][3]int `toml:"pkt_loss_rate_table" json:"pkt_loss_rate_table"`
+
+	// PktLossRateTableFile defines the path of a JSON file containing a 4x3
+	// matrix which replaces the PktLossRateTable when set.
+	PktLossRateTableFile string `toml:"pkt_loss_rate_table_file" json:"pkt_loss_rate_table_file"`
+
+	// PktLossEMAAlpha defines the smoothing factor (0 - 1] of the packet-loss
+	// moving average. Higher values react faster to recent losses.
+	PktLossEMAAlpha float32 `toml:"pkt_loss_ema_alpha" json:"pkt_loss_ema_alpha"`
+
+	// PktLossMaxGap defines the max. number of lost frames a single
+	// frame-counter gap contributes to the packet-loss. Larger gaps, e.g.
+	// when the device was offline, are clamped. 0 disables the cap.
+	PktLossMaxGap int `toml:"pkt_loss_max_gap" json:"pkt_loss_max_gap"`
+
+	// PktLossPerDevice makes that the packet-loss moving average is kept per
+	// device across requests (in memory), instead of being replayed from the
+	// history.
+	PktLossPerDevice bool `toml:"pkt_loss_per_device" json:"pkt_loss_per_device"`
+
+	// PktLossGatewayWeighting makes that frame-counter gaps between two
+	// uplinks received by a single gateway count half.
+	PktLossGatewayWeighting bool `toml:"pkt_loss_gateway_weighting" json:"pkt_loss_gateway_weighting"`
+
+	// InstallationMarginOverride replaces the installation margin of the
+	// network server when set.
+	InstallationMarginOverride *float32 `toml:"installation_margin_override" json:"installation_margin_override"`
+
+	// InstallationMarginMin raises the installation margin of the network
+	// server to this value when set.
+	InstallationMarginMin *float32 `toml:"installation_margin_min" json:"installation_margin_min"`
+
+	// InstallationMarginMax lowers the installation margin of the network
+	// server to this value when set.
+	InstallationMarginMax *float32 `toml:"installation_margin_max" json:"installation_margin_max"`
+
+	// SNRStrategy defines how the representative SNR is derived from the
+	// uplink history: max, min, median, percentile, pNN (e.g. p90), ewma,
+	// mean (avg), weighted-mean, trimmed-mean or recency-weighted.
+	SNRStrategy string `toml:"snr_strategy" json:"snr_strategy"`
+
+	// SNRPercentile defines the percentile (0 - 100) used by the percentile
+	// SNR strategy.
+	SNRPercentile float64 `toml:"snr_percentile" json:"snr_percentile"`
+
+	// SNREWMAAlpha defines the smoothing factor (0 - 1] used by the ewma SNR
+	// strategy. Higher values give more weight to recent uplinks.
+	SNREWMAAlpha float32 `toml:"snr_ewma_alpha" json:"snr_ewma_alpha"`
+
+	// SNRTrimFraction defines the fraction [0 - 0.5) of the lowest and of the
+	// highest SNRs which are dropped by the trimmed-mean SNR strategy.
+	SNRTrimFraction float64 `toml:"snr_trim_fraction" json:"snr_trim_fraction"`
+
+	// SNRRecencyFloor defines the weight [0 - 1] of the oldest uplink for the
+	// recency-weighted SNR strategy, the newest uplink has weight 1.
+	SNRRecencyFloor float64 `toml:"snr_recency_floor" json:"snr_recency_floor"`
+
+	// SNRWindow defines the number of most recent uplinks from which the
+	// representative SNR is derived. 0 uses the complete history.
+	SNRWindow int `toml:"snr_window" json:"snr_window"`
+
+	// SNROutlierSigma drops the uplinks whose SNR is more than this number of
+	// standard deviations below the mean before the SNR strategy runs. 0
+	// disables the filter.
+	SNROutlierSigma float64 `toml:"snr_outlier_sigma" json:"snr_outlier_sigma"`
+
+	// SNRGatewayWeighting defines the weight of an uplink by its gateway
+	// count for the weighted-mean SNR strategy: linear, sqrt or log.
+	SNRGatewayWeighting string `toml:"snr_gateway_weighting" json:"snr_gateway_weighting"`
+
+	// SNRGatewaySaturation defines the gateway count above which the weight
+	// no longer increases. 0 does not limit the weight.
+	SNRGatewaySaturation int `toml:"snr_gateway_saturation" json:"snr_gateway_saturation"`
+
+	// ConservativeNbTrans makes that NbTrans is never decreased, only kept
+	// or increased.
+	ConservativeNbTrans bool `toml:"conservative_nb_trans" json:"conservative_nb_trans"`
+
+	// MinNbTrans defines the min. NbTrans (1 - 15) which is returned.
+	MinNbTrans int `toml:"min_nb_trans" json:"min_nb_trans"`
+
+	// MaxNbTrans defines the max. NbTrans (1 - 15) which is returned.
+	MaxNbTrans int `toml:"max_nb_trans" json:"max_nb_trans"`
+
+	// DisableNbTrans makes that NbTrans is never changed, e.g. when it is
+	// managed out-of-band.
+	DisableNbTrans bool `toml:"disable_nb_trans" json:"disable_nb_trans"`
+
+	// ConfirmedDevEUIs defines the devices which send confirmed uplinks, their
+	// NbTrans is kept at 1.
+	ConfirmedDevEUIs []string `toml:"confirmed_dev_euis" json:"confirmed_dev_euis"`
+
+	// MinDR defines the DR below which the DR is never decreased. Negative
+	// steps only increase the TxPower at this DR.
+	MinDR int `toml:"min_dr" json:"min_dr"`
+
+	// AS923DwellTime makes that the DR is never below DR2 in the AS923
+	// regions, as DR0 and DR1 are not allowed with the uplink dwell-time
+	// limitation.
+	AS923DwellTime bool `toml:"as923_dwell_time" json:"as923_dwell_time"`
+
+	// MinTxPowerIndex defines the TxPowerIndex below which the TxPowerIndex
+	// is never decreased (the TxPower never increased), e.g. to stay within
+	// the max. ERP of the region. Negative steps decrease the DR instead.
+	MinTxPowerIndex int `toml:"min_tx_power_index" json:"min_tx_power_index"`
+
+	// MaxIterations defines the max. number of DR / TxPower steps which are
+	// applied per request, as safeguard. 0 uses the number of available DR
+	// and TxPower steps.
+	MaxIterations int `toml:"max_iterations" json:"max_iterations"`
+
+	// MaxStepsPerCall defines the max. number of DR / TxPower steps which are
+	// applied per request, so that the device converges over several
+	// downlinks. 0 does not limit the steps.
+	MaxStepsPerCall int `toml:"max_steps_per_call" json:"max_steps_per_call"`
+
+	// MaxDownSteps defines the max. number of negative steps (lower DR /
+	// higher TxPower) which are applied per request. The remaining steps are
+	// discarded. 0 does not limit the steps.
+	MaxDownSteps int `toml:"max_down_steps" json:"max_down_steps"`
+
+	// Mode defines in which directions the DR is changed: symmetric or
+	// conservative, which never decreases the DR.
+	Mode string `toml:"mode" json:"mode"`
+
+	// DRIncreaseThreshold defines the min. number of positive steps before
+	// the DR is increased. With fewer steps only the TxPower is decreased.
+	DRIncreaseThreshold int `toml:"dr_increase_threshold" json:"dr_increase_threshold"`
+
+	// MinGatewayCount defines the min. number of gateways which must have
+	// received each uplink of the history before the DR is increased. 0
+	// disables this check.
+	MinGatewayCount int `toml:"min_gateway_count" json:"min_gateway_count"`
+
+	// SingleGatewayMargin defines the margin (dB) which is added to the
+	// required SNR of devices which are received by a single gateway (the
+	// median gateway count of the history is 1).
+	SingleGatewayMargin float32 `toml:"single_gateway_margin" json:"single_gateway_margin"`
+
+	// HysteresisDB defines a dead-band (dB) around zero SNR margin. Positive
+	// steps are only applied when the margin exceeds HysteresisDB, negative
+	// steps only when the margin is below -HysteresisDB.
+	HysteresisDB float32 `toml:"hysteresis_db" json:"hysteresis_db"`
+
+	// HysteresisUpDB replaces the HysteresisDB for positive steps when set.
+	HysteresisUpDB *float32 `toml:"hysteresis_up_db" json:"hysteresis_up_db"`
+
+	// HysteresisDownDB replaces the HysteresisDB for negative steps when set.
+	HysteresisDownDB *float32 `toml:"hysteresis_down_db" json:"hysteresis_down_db"`
+
+	// CooldownFrames defines the number of requests after a change during
+	// which the current values are kept, per device. 0 disables the
+	// cooldown.
+	CooldownFrames int `toml:"cooldown_frames" json:"cooldown_frames"`
+
+	// SNRSaturation enables the RSSI fallback when set. When the SNR is at or
+	// above this value (dB), the margin is estimated from the RSSI instead.
+	SNRSaturation *float32 `toml:"snr_saturation" json:"snr_saturation"`
+
+	// RSSIReference defines the RSSI (dBm) which corresponds to a zero margin
+	// for the RSSI fallback.
+	RSSIReference float32 `toml:"rssi_reference" json:"rssi_reference"`
+
+	// RSSINoiseFloor enables the RSSI fallback for uplink histories without
+	// SNR when set. The SNR is then estimated as the RSSI minus this noise
+	// floor (dBm).
+	RSSINoiseFloor *float32 `toml:"rssi_noise_floor" json:"rssi_noise_floor"`
+
+	// PlausibleSNRMin and PlausibleSNRMax define the SNR range (dB) of
+	// plausible uplinks when set, other uplinks are discarded.
+	PlausibleSNRMin *float32 `toml:"plausible_snr_min" json:"plausible_snr_min"`
+	PlausibleSNRMax *float32 `toml:"plausible_snr_max" json:"plausible_snr_max"`
+
+	// PlausibleGatewayCountMin defines the min. gateway count of plausible
+	// uplinks, other uplinks are discarded. 0 disables this check.
+	PlausibleGatewayCountMin int `toml:"plausible_gateway_count_min" json:"plausible_gateway_count_min"`
+
+	// DryRun makes that the calculated response is only logged, the current
+	// device state is returned to the network server. The change metrics and
+	// the cooldown do not count the logged changes.
+	DryRun bool `toml:"dry_run" json:"dry_run"`
+
+	// RequiredSNR replaces the required SNR (dB) of the network server, per
+	// DR (0 - 15). When the DR is missing, the network-server value is used.
+	RequiredSNR map[string]float32 `toml:"required_snr" json:"required_snr"`
+
+	// RegionInstallationMargin defines the margin (dB) which is added to the
+	// installation margin of the network server, per region (e.g. EU868).
+	RegionInstallationMargin map[string]float32 `toml:"region_installation_margin" json:"region_installation_margin"`
+
+	// DRMargin defines the margin (dB) which is added to the installation
+	// margin, per DR (0 - 15). When increasing the DR, the margin of the
+	// target DR is used.
+	DRMargin map[string]float32 `toml:"dr_margin" json:"dr_margin"`
+
+	// RegionStepSize replaces the StepSize per region (e.g. US915). The
+	// default contains the regions with 2.5 dB between the DRs (US915 and
+	// AU915), a configured table replaces it.
+	RegionStepSize map[string]float32 `toml:"region_step_size" json:"region_step_size"`
+}
+
+// configTemplate is the commented TOML representation of Config.
+var configTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"array": tomlArray,
+}).Parse(`# ADR algorithm:
+#   alitecs: the ALITECS algorithm, using the settings below
+#   lora:    the textbook LoRaWAN algorithm, using the max. SNR and the
+#            installation margin of the network server, and the ratio of
+#            lost frames for NbTrans. The settings below are ignored, except
+#            for dry_run.
+# The plugin ID and name reflect the algorithm (e.g. <plugin-id>-lora), they
+# are read by the network server at startup.
+algorithm = "{{ .Algorithm }}"
+
+# SNR margin (dB) which equals a single DR or TxPower step (1 - 10). Smaller
+# steps converge faster, larger steps are more stable.
+step_size = {{ .StepSize }}
+
+# Number of uplink history elements which are needed before the DR, TxPower or
+# NbTrans is changed (6 - 20, the network server keeps at most 20 elements).
+required_history_count = {{ .RequiredHistoryCount }}
+
+# Min. number of uplink history elements without any lost frame, which are
+# needed to increase the DR or decrease the TxPower before
+# required_history_count is reached, e.g. for new devices. The SNR margin of
+# every element must give at least one step. The TxPower is only increased
+# with the full history. 0 disables the quick start.
+quick_start_min_frames = {{ .QuickStartMinFrames }}
+
+# Packet-loss (%, 0 - 100, strictly increasing) upper bounds of the first three
+# rows of the pkt_loss_rate_table. Packet-loss above the last threshold selects
+# the fourth row.
+pkt_loss_thresholds = {{ array .PktLossThresholds }}
+
+# New NbTrans (1 - 15), per packet-loss row (see pkt_loss_thresholds) and
+# current NbTrans (column 1 - 3, a current NbTrans above 3 uses the third
+# column). Must be 4 rows of 3 columns. The result is limited to
+# min_nb_trans - max_nb_trans. An invalid table is rejected at startup.
+pkt_loss_rate_table = [
+{{- range .PktLossRateTable }}
+  {{ array . }},
+{{- end }}
+]
+
+# Path of a JSON file containing a 4x3 matrix (NbTrans 1 - 15) which replaces
+# pkt_loss_rate_table, e.g. [[1,1,2],[1,2,3],[2,3,3],[3,3,3]]. When the file
+# is invalid, pkt_loss_rate_table is used.
+{{ if .PktLossRateTableFile -}}
+pkt_loss_rate_table_file = {{ printf "%q" .PktLossRateTableFile }}
+{{- else -}}
+# pkt_loss_rate_table_file = "/etc/chirpstack-adr/pkt-loss-rate-table.json"
+{{- end }}
+
+# Smoothing factor (0 - 1] of the packet-loss moving average over the expected
+# frames of the uplink history. Higher values react faster to recent losses.
+pkt_loss_ema_alpha = {{ .PktLossEMAAlpha }}
+
+# Max. number of lost frames a single frame-counter gap contributes to the
+# packet-loss. Larger gaps, e.g. when the device was offline, are clamped so
+# that a single outage does not dominate the packet-loss. 0 disables the cap.
+pkt_loss_max_gap = {{ .PktLossMaxGap }}
+
+# Keep the packet-loss moving average per device across requests, instead of
+# replaying it from the uplink history. Each request adds the uplinks received
+# and the frames lost since the previously handled uplink, which makes the
+# NbTrans decisions smoother. Unseen
+# devices start neutral, without packet-loss. The state is kept in memory only:
+# it is lost on a restart of the plugin and grows with the number of devices.
+pkt_loss_per_device = {{ .PktLossPerDevice }}
+
+# Count the lost frames of a frame-counter gap half when the uplinks before and
+# after the gap were received by a single gateway. Such gaps may be caused by a
+# temporary loss of gateway coverage rather than by the link of the device.
+pkt_loss_gateway_weighting = {{ .PktLossGatewayWeighting }}
+
+# Replaces the installation margin (dB) of the network server when set.
+{{ if .InstallationMarginOverride -}}
+installation_margin_override = {{ .InstallationMarginOverride }}
+{{- else -}}
+# installation_margin_override = 10
+{{- end }}
+
+# Clamp the installation margin (dB) of the network server to this range when
+# set. A warning is logged once when a clamp is applied. The override above is
+# not clamped.
+{{ if .InstallationMarginMin -}}
+installation_margin_min = {{ .InstallationMarginMin }}
+{{- else -}}
+# installation_margin_min = 5
+{{- end }}
+{{ if .InstallationMarginMax -}}
+installation_margin_max = {{ .InstallationMarginMax }}
+{{- else -}}
+# installation_margin_max = 15
+{{- end }}
+
+# Strategy to derive the representative SNR from the uplink history:
+#   max:        the max. SNR
+#   min:        the min. SNR, the link budget is evaluated against the worst
+#               uplink so that a single deep fade blocks DR increases
+#   median:     the median SNR, which is less sensitive to a single good uplink
+#   percentile: the snr_percentile percentile SNR, e.g. 25 for a conservative
+#               estimate
+#   pNN:        the NN (0 - 100) percentile SNR, e.g. p25 or p90, ignoring
+#               snr_percentile
+#   ewma:       the exponentially weighted moving average SNR, which favors
+#               recent uplinks (see snr_ewma_alpha)
+#   mean:       the mean SNR, a single good uplink received by a close gateway
+#               does not cause a DR increase on its own
+#   avg:        alias of mean
+#   weighted-mean:
+#               the mean SNR, weighted by the number of receiving gateways
+#   trimmed-mean:
+#               the mean SNR without the lowest and highest SNRs (see
+#               snr_trim_fraction), which rejects outliers in both directions
+#   recency-weighted:
+#               the mean SNR, weighted linearly by age from 1 for the newest
+#               uplink down to snr_recency_floor for the oldest, a middle
+#               ground between ewma and snr_window
+snr_strategy = "{{ .SNRStrategy }}"
+
+# Percentile (0 - 100) used by the percentile snr_strategy.
+snr_percentile = {{ .SNRPercentile }}
+
+# Smoothing factor (0 - 1] used by the ewma snr_strategy. Higher values give
+# more weight to recent uplinks.
+snr_ewma_alpha = {{ .SNREWMAAlpha }}
+
+# Fraction [0 - 0.5) of the lowest and of the highest SNRs which are dropped
+# by the trimmed-mean snr_strategy, rounded down. Short histories with fewer
+# than 1 / snr_trim_fraction uplinks keep all SNRs.
+snr_trim_fraction = {{ .SNRTrimFraction }}
+
+# Weight [0 - 1] of the oldest uplink for the recency-weighted snr_strategy,
+# the weight rises linearly to 1 for the newest uplink. Uplinks with the same
+# frame-counter get the same weight. Histories with fewer than 3 uplinks use
+# the plain mean.
+snr_recency_floor = {{ .SNRRecencyFloor }}
+
+# Number of most recent uplinks (by frame-counter) from which the
+# representative SNR is derived (>= 0), so that a device whose environment
+# changed is not judged on stale measurements. The packet-loss still uses the
+# complete history. 0, or a window larger than the history, uses the complete
+# history.
+snr_window = {{ .SNRWindow }}
+
+# Drop the uplinks whose SNR is more than this number of standard deviations
+# below the mean SNR (>= 0), e.g. an uplink captured during a deep fade,
+# before the representative SNR is derived by snr_strategy (after
+# snr_window). The packet-loss still uses the complete history. 0 disables
+# the filter.
+snr_outlier_sigma = {{ .SNROutlierSigma }}
+
+# Weight of an uplink by its gateway count n for the weighted-mean
+# snr_strategy:
+#   linear: n
+#   sqrt:   the square root of n
+#   log:    1 + ln(n), so that additional gateways count less and less
+snr_gateway_weighting = "{{ .SNRGatewayWeighting }}"
+
+# Gateway count (>= 0) above which the weight of an uplink no longer
+# increases, e.g. 3 so that a dense gateway deployment does not dominate.
+# 0 does not limit the weight.
+snr_gateway_saturation = {{ .SNRGatewaySaturation }}
+
+# Never decrease NbTrans, only keep or increase it. For deployments where
+# reliability is more important than airtime.
+conservative_nb_trans = {{ .ConservativeNbTrans }}
+
+# Min. NbTrans (1 - 15) which is returned. The LoRaWAN specification defines
+# 1 - 3.
+min_nb_trans = {{ .MinNbTrans }}
+
+# Max. NbTrans (1 - 15, >= min_nb_trans) which is returned, e.g. 2 to limit
+# the airtime even under high packet-loss. Values above 3 are only returned
+# when pkt_loss_rate_table or min_nb_trans contain them. When max_nb_trans is
+# below min_nb_trans, both fall back to their default.
+max_nb_trans = {{ .MaxNbTrans }}
+
+# Never change NbTrans, e.g. when it is managed out-of-band. The DR and
+# TxPower are still adjusted.
+disable_nb_trans = {{ .DisableNbTrans }}
+
+# DevEUIs of the devices which send confirmed uplinks. These are already
+# retransmitted by the device when not acknowledged, therefore their NbTrans is
+# kept at 1. The ADR request does not tell whether a device sends confirmed
+# uplinks, so these devices must be listed.
+{{ if .ConfirmedDevEUIs -}}
+confirmed_dev_euis = {{ array .ConfirmedDevEUIs }}
+{{- else -}}
+# confirmed_dev_euis = ["0102030405060708"]
+{{- end }}
+
+# DR (0 - 15) below which the DR is never decreased, e.g. 2 to limit the
+# airtime of devices at the edge of the coverage. At this DR, negative steps
+# only increase the TxPower.
+min_dr = {{ .MinDR }}
+
+# With the uplink dwell-time limitation of AS923, DR0 and DR1 are not allowed.
+# When enabled, the DR of devices in the AS923 regions (AS923, AS923-2 etc.) is
+# kept at or raised to DR2, regardless of the steps. Enable it when the
+# network server has the dwell-time limitation enabled.
+as923_dwell_time = {{ .AS923DwellTime }}
+
+# TxPowerIndex (0 - 15) below which the TxPowerIndex is never decreased, which
+# caps the TxPower, e.g. to stay within the max. ERP of the region. At this
+# TxPowerIndex, negative steps decrease the DR instead.
+min_tx_power_index = {{ .MinTxPowerIndex }}
+
+# Max. number of DR / TxPower steps which are applied per request, as
+# safeguard. A warning is logged when it is reached. 0 uses the number of
+# available DR and TxPower steps, which never limits the result.
+max_iterations = {{ .MaxIterations }}
+
+# Max. number of DR / TxPower steps which are applied per request (>= 0), in
+# both directions. Jumping several DRs at once can be destabilizing, with a
+# limit the device converges over several downlinks. 0 does not limit the
+# steps.
+max_steps_per_call = {{ .MaxStepsPerCall }}
+
+# Max. number of negative DR / TxPower steps (lower DR / higher TxPower) which
+# are applied per request (>= 0), in addition to max_steps_per_call. The
+# remaining steps are discarded, not deferred: the next request calculates the
+# steps again from its own history. 0 does not limit the steps.
+max_down_steps = {{ .MaxDownSteps }}
+
+# ADR mode:
+#   symmetric:    the DR is increased and decreased
+#   conservative: the DR is never decreased, negative steps only increase the
+#                 TxPower. The device stays at its DR when the link degrades.
+mode = "{{ .Mode }}"
+
+# Min. number of positive steps before the DR is increased (>= 1). With fewer
+# steps only the TxPower is decreased. Values above 1 add a dead-band which
+# avoids DR oscillation when the SNR margin hovers around a step boundary.
+dr_increase_threshold = {{ .DRIncreaseThreshold }}
+
+# Min. number of gateways which must have received each uplink of the history
+# before the DR is increased. Devices received by fewer gateways are likely at
+# the edge of coverage. 0 disables this check.
+min_gateway_count = {{ .MinGatewayCount }}
+
+# Margin (dB, >= 0) which is added to the required SNR of devices which are
+# received by a single gateway, i.e. the median gateway count of the uplink
+# history is 1. For these devices a too aggressive DR increase means a total
+# loss rather than less redundancy. Devices received by multiple gateways are
+# not affected. 0 disables the margin.
+single_gateway_margin = {{ .SingleGatewayMargin }}
+
+# Dead-band (dB) around zero SNR margin (>= 0). Positive steps are only applied
+# when the margin exceeds hysteresis_db, negative steps only when the margin is
+# below -hysteresis_db. This avoids DR oscillation near a step boundary.
+hysteresis_db = {{ .HysteresisDB }}
+
+# Replaces hysteresis_db (>= 0) for positive steps when set, e.g. 5 to only
+# increase the DR or decrease the TxPower with a margin above 5 dB.
+{{ if .HysteresisUpDB -}}
+hysteresis_up_db = {{ .HysteresisUpDB }}
+{{- else -}}
+# hysteresis_up_db = 5
+{{- end }}
+
+# Replaces hysteresis_db (>= 0) for negative steps when set, e.g. 1 to
+# increase the TxPower or decrease the DR as soon as the margin is below -1 dB
+# (and a step, see step_size).
+{{ if .HysteresisDownDB -}}
+hysteresis_down_db = {{ .HysteresisDownDB }}
+{{- else -}}
+# hysteresis_down_db = 1
+{{- end }}
+
+# Number of uplinks after a change of the DR, TxPower or NbTrans during which
+# the current values are kept, per device. This gives the device and the
+# network server time to apply the change. 0 disables the cooldown.
+cooldown_frames = {{ .CooldownFrames }}
+
+# In strong-signal deployments the SNR saturates at the receiver ceiling and
+# no longer reflects the available headroom. When set and the SNR is at or
+# above snr_saturation (dB), the margin is estimated from the max. RSSI of the
+# uplink history minus rssi_reference (dBm) instead. This requires a network
+# server which reports the RSSI (v3.16 or later).
+{{ if .SNRSaturation -}}
+snr_saturation = {{ .SNRSaturation }}
+{{- else -}}
+# snr_saturation = 10
+{{- end }}
+rssi_reference = {{ .RSSIReference }}
+
+# Some gateway firmware reports the RSSI but no SNR. When set and all SNRs of
+# the uplink history are 0 or missing, the SNR is estimated from the max. RSSI
+# minus rssi_noise_floor (dBm) and a warning is logged. Like snr_saturation
+# this requires a network server which reports the RSSI.
+{{ if .RSSINoiseFloor -}}
+rssi_noise_floor = {{ .RSSINoiseFloor }}
+{{- else -}}
+# rssi_noise_floor = -117
+{{- end }}
+
+# Uplinks outside these bounds are discarded before the SNR statistics, e.g. an
+# SNR of +35 dB or a gateway count of 0 after a restore of the network-server
+# database. Uplinks without SNR (-999) are not checked against the SNR range.
+# A discarded uplink still counts as received for the packet-loss. When no
+# uplink is left, the current values are kept. Unset, or 0 for the gateway
+# count, disables the check.
+{{ if .PlausibleSNRMin -}}
+plausible_snr_min = {{ .PlausibleSNRMin }}
+{{- else -}}
+# plausible_snr_min = -30
+{{- end }}
+{{ if .PlausibleSNRMax -}}
+plausible_snr_max = {{ .PlausibleSNRMax }}
+{{- else -}}
+# plausible_snr_max = 20
+{{- end }}
+plausible_gateway_count_min = {{ .PlausibleGatewayCountMin }}
+
+# Only log the calculated DR, TxPower and NbTrans, but return the current
+# device state to the network server. Use this to observe the algorithm before
+# enabling it. The change metrics and the cooldown only count applied changes.
+dry_run = {{ .DryRun }}
+{{- /* Tables must come after all top-level keys. */}}
+
+# Required SNR (dB) per DR, replacing the values of the network server for
+# non-standard regional parameters. All DRs (0 - 15) should be present, missing
+# DRs use the network-server value.
+{{ if .RequiredSNR -}}
+[required_snr]
+{{- range $dr, $snr := .RequiredSNR }}
+"{{ $dr }}" = {{ $snr }}
+{{- end }}
+{{- else -}}
+# [required_snr]
+# "0" = -20
+# "1" = -17.5
+{{- end }}
+
+# Margin (dB) which is added to the installation margin of the network server,
+# per region name as reported by the network server. Other regions use the
+# network-server value unchanged. It is not added to
+# installation_margin_override.
+{{ if .RegionInstallationMargin -}}
+[region_installation_margin]
+{{- range $region, $margin := .RegionInstallationMargin }}
+{{ $region }} = {{ $margin }}
+{{- end }}
+{{- else -}}
+# [region_installation_margin]
+# US915 = 2
+# AS923 = -1
+{{- end }}
+
+# Margin (dB) which is added to the installation margin, per DR (0 - 15), e.g.
+# more headroom at the high DRs where the link degrades fast. When increasing
+# the DR, the margin of the target DR must be met. Missing DRs use 0.
+{{ if .DRMargin -}}
+[dr_margin]
+{{- range $dr, $margin := .DRMargin }}
+"{{ $dr }}" = {{ $margin }}
+{{- end }}
+{{- else -}}
+# [dr_margin]
+# "4" = 1
+# "5" = 2
+{{- end }}
+
+# Step size (dB, 1 - 10) per region name as reported by the network server,
+# for regions where the SNR difference between the DRs differs. Other regions
+# use step_size. The default table is US915 = 2.5 and AU915 = 2.5, an empty
+# table makes that all regions use step_size.
+[region_step_size]
+{{- range $region, $size := .RegionStepSize }}
+{{ $region }} = {{ $size }}
+{{- end }}
+`))
+
+// defaultConfig returns the default configuration.
+func defaultConfig() Config {
+	return Config{
+		Algorithm:            algorithmALITECS,
+		StepSize:             3,
+		RequiredHistoryCount: 20,
+		QuickStartMinFrames:  5,
+		PktLossThresholds:    [3]float32{5, 10, 30},
+		PktLossRateTable: [4][3]int{
+			{1, 1, 2},
+			{1, 2, 3},
+			{2, 3, 3},
+			{3, 3, 3},
+		},
+		PktLossEMAAlpha:     0.1,
+		PktLossMaxGap:       0,
+		SNRStrategy:         snrStrategyMax,
+		Mode:                modeSymmetric,
+		SNRPercentile:       50,
+		SNRTrimFraction:     0.1,
+		SNRRecencyFloor:     0.2,
+		SNRGatewayWeighting: gatewayWeightingLinear,
+		SNREWMAAlpha:        0.3,
+		RegionStepSize: map[string]float32{
+			"US915": 2.5,
+			"AU915": 2.5,
+		},
+		MinNbTrans:          1,
+		MaxNbTrans:          3,
+		DRIncreaseThreshold: 1,
+		RSSIReference:       -120,
+	}
+}
+
+// writeTOML writes the configuration as commented TOML document to w. The
+// output can be used as configuration file.
+func (c *Config) writeTOML(w io.Writer) error {
+	return configTemplate.Execute(w, c)
+}
+
+// tomlArray formats the given array as TOML array.
+func tomlArray(v interface{}) string {
+	var items []string
+
+	switch v := v.(type) {
+	case [3]float32:
+		for _, f := range v {
+			items = append(items, fmt.Sprint(f))
+		}
+	case [3]int:
+		for _, i := range v {
+			items = append(items, fmt.Sprint(i))
+		}
+	case []string:
+		for _, s := range v {
+			items = append(items, fmt.Sprintf("%q", s))
+		}
+	}
+
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+// loadConfig returns the default configuration, overridden by the values of
+// the given TOML file, then by the environment and then by the given flag
+// values. When the file does not exist, only the environment and the flags
+// are applied. Invalid values fall back to their default, except for an
+// invalid pkt_loss_rate_table, which returns an error.
+func loadConfig(path string, flags map[string]string) (Config, error) {
+	conf := defaultConfig()
+
+	if err := conf.loadFile(path); err != nil {
+		return conf, err
+	}
+
+	if err := conf.loadEnv(); err != nil {
+		return conf, err
+	}
+
+	if err := conf.loadFlags(flags); err != nil {
+		return conf, err
+	}
+
+	// The default table would silently change the NbTrans decisions of
+	// the operator, reject it instead.
+	for _, err := range conf.validate() {
+		if err.key == "pkt_loss_rate_table" {
+			return conf, err
+		}
+	}
+
+	conf.loadPktLossRateTableFile()
+	conf.sanitize()
+
+	return conf, nil
+}
+
+// loadFile overrides the configuration with the values of the given file.
+// Files with the .json extension are decoded as JSON, all others as TOML.
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read config file error: %w", err)
+	}
+
+	// The decoders merge a table into the default map, the table of the file
+	// must replace it instead.
+	regionStepSize := c.RegionStepSize
+	c.RegionStepSize = nil
+	defer func() {
+		if c.RegionStepSize == nil {
+			c.RegionStepSize = regionStepSize
+		}
+	}()
+
+	if filepath.Ext(path) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("decode config file error: %w", err)
+		}
+		if err := checkJSONArrayLengths(b); err != nil {
+			return fmt.Errorf("decode config file error: %w", err)
+		}
+		return nil
+	}
+
+	md, err := toml.Decode(string(b), c)
+	if err != nil {
+		return fmt.Errorf("decode config file error: %w", err)
+	}
+
+	// Reject unknown keys, so that typos do not silently fall back to the
+	// defaults.
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		return fmt.Errorf("unknown config key(s) in %s: %v", path, undecoded)
+	}
+
+	return nil
+}
+
+// checkJSONArrayLengths returns an error when the fixed-size arrays of the
+// given JSON configuration have a different length. Unlike the TOML decoder,
+// the JSON decoder silently drops surplus elements and zeroes missing ones.
+func checkJSONArrayLengths(b []byte) error {
+	var arrays struct {
+		PktLossThresholds []float32 `json:"pkt_loss_thresholds"`
+		PktLossRateTable  [][]int   `json:"pkt_loss_rate_table"`
+	}
+	if err := json.Unmarshal(b, &arrays); err != nil {
+		return err
+	}
+
+	var c Config
+	if arrays.PktLossThresholds != nil && len(arrays.PktLossThresholds) != len(c.PktLossThresholds) {
+		return fmt.Errorf("pkt_loss_thresholds: expected array length %d, got %d", len(c.PktLossThresholds), len(arrays.PktLossThresholds))
+	}
+
+	if arrays.PktLossRateTable != nil {
+		if len(arrays.PktLossRateTable) != len(c.PktLossRateTable) {
+			return fmt.Errorf("pkt_loss_rate_table: expected %d rows, got %d", len(c.PktLossRateTable), len(arrays.PktLossRateTable))
+		}
+		for i, row := range arrays.PktLossRateTable {
+			if len(row) != len(c.PktLossRateTable[i]) {
+				return fmt.Errorf("pkt_loss_rate_table: expected %d columns at row %d, got %d", len(c.PktLossRateTable[i]), i+1, len(row))
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadPktLossRateTableFile overrides the PktLossRateTable with the matrix of
+// the PktLossRateTableFile, if set. When the file is invalid, the current
+// table is kept and a warning is logged.
+func (c *Config) loadPktLossRateTableFile() {
+	if c.PktLossRateTableFile == "" {
+		return
+	}
+
+	table, err := readPktLossRateTable(c.PktLossRateTableFile)
+	if err != nil {
+		log.WithError(err).WithField("file", c.PktLossRateTableFile).Warning("Invalid pkt_loss_rate_table_file, falling back to pkt_loss_rate_table")
+		return
+	}
+
+	c.PktLossRateTable = table
+}
+
+// readPktLossRateTable reads the JSON encoded packet-loss rate table from
+// the given file. It must be a 4x3 matrix with NbTrans values within 1 - 15.
+func readPktLossRateTable(path string) ([4][3]int, error) {
+	var table [4][3]int
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return table, fmt.Errorf("read pkt_loss_rate_table_file error: %w", err)
+	}
+
+	var rows [][]int
+	if err := json.Unmarshal(b, &rows); err != nil {
+		return table, fmt.Errorf("decode pkt_loss_rate_table_file error: %w", err)
+	}
+
+	if len(rows) != len(table) {
+		return table, fmt.Errorf("pkt_loss_rate_table_file: expected %d rows, got %d", len(table), len(rows))
+	}
+
+	for i, row := range rows {
+		if len(row) != len(table[i]) {
+			return table, fmt.Errorf("pkt_loss_rate_table_file: expected %d columns at row %d, got %d", len(table[i]), i+1, len(row))
+		}
+
+		for j, nbTrans := range row {
+			if nbTrans < 1 || nbTrans > 15 {
+				return table, fmt.Errorf("pkt_loss_rate_table_file: NbTrans must be within 1 - 15, got %d at row %d, column %d", nbTrans, i+1, j+1)
+			}
+			table[i][j] = nbTrans
+		}
+	}
+
+	return table, nil
+}
+
+// setting is a value of the configuration which can be set by environment
+// variable or flag.
+type setting struct {
+	// name is the name of the environment variable without envPrefix, see
+	// flagName for the name of the flag.
+	name  string
+	parse func(string) error
+}
+
+// settings returns the values of the configuration which can be set by
+// environment variable or flag.
+func (c *Config) settings() []setting {
+	return []setting{
+		{"ALGORITHM", func(v string) error {
+			c.Algorithm = v
+			return nil
+		}},
+		// STEP_DB is an alias of STEP_SIZE, which comes after it and thus
+		// takes precedence.
+		{"STEP_DB", func(v string) error {
+			return parseFloat32(v, &c.StepSize)
+		}},
+		{"STEP_SIZE", func(v string) error {
+			return parseFloat32(v, &c.StepSize)
+		}},
+		{"HISTORY_COUNT", func(v string) error {
+			return parseInt(v, &c.RequiredHistoryCount)
+		}},
+		{"QUICK_START_MIN_FRAMES", func(v string) error {
+			return parseInt(v, &c.QuickStartMinFrames)
+		}},
+		{"PKT_LOSS_THRESHOLDS", func(v string) error {
+			return parseFloat32List(v, c.PktLossThresholds[:])
+		}},
+		{"PKT_LOSS_RATE_TABLE", func(v string) error {
+			return parseIntTable(v, c.PktLossRateTable[:])
+		}},
+		{"PKT_LOSS_RATE_TABLE_FILE", func(v string) error {
+			c.PktLossRateTableFile = v
+			return nil
+		}},
+		{"EMA_ALPHA", func(v string) error {
+			return parseFloat32(v, &c.PktLossEMAAlpha)
+		}},
+		{"PKT_LOSS_MAX_GAP", func(v string) error {
+			return parseInt(v, &c.PktLossMaxGap)
+		}},
+		{"LOSS_GATEWAY_WEIGHTING", func(v string) error {
+			return parseBool(v, &c.PktLossGatewayWeighting)
+		}},
+		{"PKT_LOSS_PER_DEVICE", func(v string) error {
+			return parseBool(v, &c.PktLossPerDevice)
+		}},
+		{"INSTALLATION_MARGIN_OVERRIDE", func(v string) error {
+			// Unlike the other settings, an unparseable override is not fatal,
+			// the installation margin of the network server is used instead.
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				log.WithError(err).Warning("Invalid installation margin override, using the network-server installation margin")
+				c.InstallationMarginOverride = nil
+				return nil
+			}
+			c.InstallationMarginOverride = &f
+			return nil
+		}},
+		{"INSTALLATION_MARGIN_MIN", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.InstallationMarginMin = &f
+			return nil
+		}},
+		{"INSTALLATION_MARGIN_MAX", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.InstallationMarginMax = &f
+			return nil
+		}},
+		{"SNR_STRATEGY", func(v string) error {
+			c.SNRStrategy = v
+			return nil
+		}},
+		{"SNR_PERCENTILE", func(v string) error {
+			return parseFloat64(v, &c.SNRPercentile)
+		}},
+		{"SNR_EWMA_ALPHA", func(v string) error {
+			return parseFloat32(v, &c.SNREWMAAlpha)
+		}},
+		{"SNR_TRIM_FRACTION", func(v string) error {
+			return parseFloat64(v, &c.SNRTrimFraction)
+		}},
+		{"SNR_RECENCY_FLOOR", func(v string) error {
+			return parseFloat64(v, &c.SNRRecencyFloor)
+		}},
+		{"SNR_WINDOW", func(v string) error {
+			return parseInt(v, &c.SNRWindow)
+		}},
+		{"SNR_OUTLIER_SIGMA", func(v string) error {
+			return parseFloat64(v, &c.SNROutlierSigma)
+		}},
+		{"SNR_GATEWAY_WEIGHTING", func(v string) error {
+			c.SNRGatewayWeighting = v
+			return nil
+		}},
+		{"SNR_GATEWAY_SATURATION", func(v string) error {
+			return parseInt(v, &c.SNRGatewaySaturation)
+		}},
+		{"CONSERVATIVE", func(v string) error {
+			return parseBool(v, &c.ConservativeNbTrans)
+		}},
+		{"MIN_NB_TRANS", func(v string) error {
+			return parseInt(v, &c.MinNbTrans)
+		}},
+		{"MAX_NB_TRANS", func(v string) error {
+			return parseInt(v, &c.MaxNbTrans)
+		}},
+		{"DISABLE_NB_TRANS", func(v string) error {
+			return parseBool(v, &c.DisableNbTrans)
+		}},
+		{"CONFIRMED_DEVEUIS", func(v string) error {
+			c.ConfirmedDevEUIs = parseStringList(v)
+			return nil
+		}},
+		{"MIN_DR", func(v string) error {
+			return parseInt(v, &c.MinDR)
+		}},
+		{"AS923_DWELL_TIME", func(v string) error {
+			return parseBool(v, &c.AS923DwellTime)
+		}},
+		{"MIN_TX_POWER_INDEX", func(v string) error {
+			return parseInt(v, &c.MinTxPowerIndex)
+		}},
+		{"MAX_ITERATIONS", func(v string) error {
+			return parseInt(v, &c.MaxIterations)
+		}},
+		{"MAX_STEPS_PER_CALL", func(v string) error {
+			return parseInt(v, &c.MaxStepsPerCall)
+		}},
+		{"MAX_DOWN_STEPS", func(v string) error {
+			return parseInt(v, &c.MaxDownSteps)
+		}},
+		{"MODE", func(v string) error {
+			c.Mode = v
+			return nil
+		}},
+		{"DR_INCREASE_THRESHOLD", func(v string) error {
+			return parseInt(v, &c.DRIncreaseThreshold)
+		}},
+		{"MIN_GATEWAY_COUNT", func(v string) error {
+			return parseInt(v, &c.MinGatewayCount)
+		}},
+		{"SINGLE_GATEWAY_MARGIN", func(v string) error {
+			return parseFloat32(v, &c.SingleGatewayMargin)
+		}},
+		{"HYSTERESIS_DB", func(v string) error {
+			return parseFloat32(v, &c.HysteresisDB)
+		}},
+		{"HYSTERESIS_UP_DB", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.HysteresisUpDB = &f
+			return nil
+		}},
+		{"HYSTERESIS_DOWN_DB", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.HysteresisDownDB = &f
+			return nil
+		}},
+		{"COOLDOWN_FRAMES", func(v string) error {
+			return parseInt(v, &c.CooldownFrames)
+		}},
+		{"SNR_SATURATION", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.SNRSaturation = &f
+			return nil
+		}},
+		{"RSSI_REFERENCE", func(v string) error {
+			return parseFloat32(v, &c.RSSIReference)
+		}},
+		{"RSSI_NOISE_FLOOR", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.RSSINoiseFloor = &f
+			return nil
+		}},
+		{"PLAUSIBLE_SNR_MIN", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.PlausibleSNRMin = &f
+			return nil
+		}},
+		{"PLAUSIBLE_SNR_MAX", func(v string) error {
+			var f float32
+			if err := parseFloat32(v, &f); err != nil {
+				return err
+			}
+			c.PlausibleSNRMax = &f
+			return nil
+		}},
+		{"PLAUSIBLE_GATEWAY_COUNT_MIN", func(v string) error {
+			return parseInt(v, &c.PlausibleGatewayCountMin)
+		}},
+		{"DRY_RUN", func(v string) error {
+			return parseBool(v, &c.DryRun)
+		}},
+		{"REQUIRED_SNR", func(v string) error {
+			return parseFloat32Map(v, &c.RequiredSNR)
+		}},
+		{"REGION_INSTALLATION_MARGIN", func(v string) error {
+			return parseFloat32Map(v, &c.RegionInstallationMargin)
+		}},
+		{"DR_MARGIN", func(v string) error {
+			return parseFloat32Map(v, &c.DRMargin)
+		}},
+		{"REGION_STEP_SIZE", func(v string) error {
+			return parseFloat32Map(v, &c.RegionStepSize)
+		}},
+	}
+}
+
+// loadEnv overrides the configuration with the values set in the
+// environment. Values that can not be parsed return an error.
+func (c *Config) loadEnv() error {
+	for _, env := range c.settings() {
+		v, ok := os.LookupEnv(envPrefix + env.name)
+		if !ok {
+			continue
+		}
+
+		if err := env.parse(v); err != nil {
+			return fmt.Errorf("parse %s%s error: %w", envPrefix, env.name, err)
+		}
+	}
+
+	return nil
+}
+
+// loadFlags overrides the configuration with the given flag values, by
+// setting name. Values that can not be parsed return an error.
+func (c *Config) loadFlags(flags map[string]string) error {
+	for _, s := range c.settings() {
+		v, ok := flags[s.name]
+		if !ok {
+			continue
+		}
+
+		if err := s.parse(v); err != nil {
+			return fmt.Errorf("parse -%s error: %w", flagName(s.name), err)
+		}
+	}
+
+	return nil
+}
+
+// flagName returns the flag name of the given setting name, e.g. step-size
+// for STEP_SIZE.
+func flagName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// fields returns the configuration as log fields.
+func (c *Config) fields() log.Fields {
+	fields := log.Fields{
+		"algorithm":              c.Algorithm,
+		"step_size":              c.StepSize,
+		"required_history_count": c.RequiredHistoryCount,
+		"quick_start_min_frames": c.QuickStartMinFrames,
+		"pkt_loss_thresholds":    c.PktLossThresholds,
+		"pkt_loss_rate_table":    c.PktLossRateTable,
+		"pkt_loss_ema_alpha":     c.PktLossEMAAlpha,
+		"pkt_loss_max_gap":       c.PktLossMaxGap,
+		"pkt_loss_per_device":    c.PktLossPerDevice,
+		"snr_strategy":           c.SNRStrategy,
+		"snr_percentile":         c.SNRPercentile,
+		"snr_ewma_alpha":         c.SNREWMAAlpha,
+		"snr_trim_fraction":      c.SNRTrimFraction,
+		"snr_recency_floor":      c.SNRRecencyFloor,
+		"snr_window":             c.SNRWindow,
+		"snr_outlier_sigma":      c.SNROutlierSigma,
+		"snr_gateway_weighting":  c.SNRGatewayWeighting,
+		"snr_gateway_saturation": c.SNRGatewaySaturation,
+		"conservative_nb_trans":  c.ConservativeNbTrans,
+		"min_nb_trans":           c.MinNbTrans,
+		"max_nb_trans":           c.MaxNbTrans,
+		"disable_nb_trans":       c.DisableNbTrans,
+		"min_dr":                 c.MinDR,
+		"as923_dwell_time":       c.AS923DwellTime,
+		"min_tx_power_index":     c.MinTxPowerIndex,
+		"max_iterations":         c.MaxIterations,
+		"max_steps_per_call":     c.MaxStepsPerCall,
+		"max_down_steps":         c.MaxDownSteps,
+		"mode":                   c.Mode,
+		"dr_increase_threshold":  c.DRIncreaseThreshold,
+		"min_gateway_count":      c.MinGatewayCount,
+		"single_gateway_margin":  c.SingleGatewayMargin,
+		"hysteresis_db":          c.HysteresisDB,
+		"cooldown_frames":        c.CooldownFrames,
+		"rssi_reference":         c.RSSIReference,
+		"dry_run":                c.DryRun,
+	}
+
+	if c.HysteresisUpDB != nil {
+		fields["hysteresis_up_db"] = *c.HysteresisUpDB
+	}
+
+	if c.HysteresisDownDB != nil {
+		fields["hysteresis_down_db"] = *c.HysteresisDownDB
+	}
+
+	if c.SNRSaturation != nil {
+		fields["snr_saturation"] = *c.SNRSaturation
+	}
+
+	if c.RSSINoiseFloor != nil {
+		fields["rssi_noise_floor"] = *c.RSSINoiseFloor
+	}
+
+	if c.PlausibleSNRMin != nil {
+		fields["plausible_snr_min"] = *c.PlausibleSNRMin
+	}
+
+	if c.PlausibleSNRMax != nil {
+		fields["plausible_snr_max"] = *c.PlausibleSNRMax
+	}
+
+	if c.PlausibleGatewayCountMin != 0 {
+		fields["plausible_gateway_count_min"] = c.PlausibleGatewayCountMin
+	}
+
+	if c.PktLossGatewayWeighting {
+		fields["pkt_loss_gateway_weighting"] = c.PktLossGatewayWeighting
+	}
+
+	if len(c.RequiredSNR) != 0 {
+		fields["required_snr"] = c.RequiredSNR
+	}
+
+	if len(c.RegionInstallationMargin) != 0 {
+		fields["region_installation_margin"] = c.RegionInstallationMargin
+	}
+
+	if len(c.DRMargin) != 0 {
+		fields["dr_margin"] = c.DRMargin
+	}
+
+	if len(c.RegionStepSize) != 0 {
+		fields["region_step_size"] = c.RegionStepSize
+	}
+
+	if c.InstallationMarginOverride != nil {
+		fields["installation_margin_override"] = *c.InstallationMarginOverride
+	}
+
+	if c.InstallationMarginMin != nil {
+		fields["installation_margin_min"] = *c.InstallationMarginMin
+	}
+
+	if c.InstallationMarginMax != nil {
+		fields["installation_margin_max"] = *c.InstallationMarginMax
+	}
+
+	if c.PktLossRateTableFile != "" {
+		fields["pkt_loss_rate_table_file"] = c.PktLossRateTableFile
+	}
+
+	if len(c.ConfirmedDevEUIs) != 0 {
+		fields["confirmed_dev_euis"] = c.ConfirmedDevEUIs
+	}
+
+	return fields
+}
+
+// diff returns the fields which differ between c and other, formatted as
+// "old -> new".
+func (c *Config) diff(other Config) log.Fields {
+	oldFields := c.fields()
+	newFields := other.fields()
+	changed := log.Fields{}
+
+	for k := range oldFields {
+		if _, ok := newFields[k]; !ok {
+			newFields[k] = nil
+		}
+	}
+
+	for k, v := range newFields {
+		o, n := fmtField(oldFields[k]), fmtField(v)
+		if o != n {
+			changed[k] = o + " -> " + n
+		}
+	}
+
+	return changed
+}
+
+// fmtField formats the given field value, unset values are formatted as
+// "none".
+func fmtField(v interface{}) string {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return "none"
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if rv.IsNil() || (rv.Kind() != reflect.Ptr && rv.Len() == 0) {
+			return "none"
+		}
+		if rv.Kind() == reflect.Ptr {
+			return fmt.Sprint(rv.Elem().Interface())
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+func parseBool(s string, dst *bool) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
+
+func parseInt(s string, dst *int) error {
+	i, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	*dst = i
+	return nil
+}
+
+func parseFloat64(s string, dst *float64) error {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return err
+	}
+	*dst = f
+	return nil
+}
+
+func parseFloat32(s string, dst *float32) error {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+	if err != nil {
+		return err
+	}
+	*dst = float32(f)
+	return nil
+}
+
+// parseFloat32Map parses a comma-separated list of key:value pairs, e.g.
+// "0:-20,1:-17.5".
+func parseFloat32Map(s string, dst *map[string]float32) error {
+	m := make(map[string]float32)
+
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected key:value, got %q", item)
+		}
+
+		var f float32
+		if err := parseFloat32(kv[1], &f); err != nil {
+			return err
+		}
+		m[strings.TrimSpace(kv[0])] = f
+	}
+
+	*dst = m
+	return nil
+}
+
+// parseStringList parses a comma-separated list, empty items are skipped.
+func parseStringList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseFloat32List parses a comma-separated list, which must have exactly
+// len(dst) items.
+func parseFloat32List(s string, dst []float32) error {
+	items := strings.Split(s, ",")
+	if len(items) != len(dst) {
+		return fmt.Errorf("expected %d comma-separated values, got %d", len(dst), len(items))
+	}
+
+	for i := range items {
+		if err := parseFloat32(items[i], &dst[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseIntTable parses a table of semicolon-separated rows of
+// comma-separated values, e.g. "1,1,2;1,2,3;2,3,3;3,3,3".
+func parseIntTable(s string, dst [][3]int) error {
+	rows := strings.Split(s, ";")
+	if len(rows) != len(dst) {
+		return fmt.Errorf("expected %d semicolon-separated rows, got %d", len(dst), len(rows))
+	}
+
+	for i := range rows {
+		cols := strings.Split(rows[i], ",")
+		if len(cols) != len(dst[i]) {
+			return fmt.Errorf("expected %d comma-separated values in row %d, got %d", len(dst[i]), i+1, len(cols))
+		}
+
+		for j := range cols {
+			if err := parseInt(cols[j], &dst[i][j]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// configError describes an invalid configuration value.
+type configError struct {
+	key string
+	msg string
+}
+
+func (e configError) Error() string {
+	return e.key + ": " + e.msg
+}
+
+// validate returns all invalid configuration values.
+func (c *Config) validate() []configError {
+	var errs []configError
+
+	if !containsString(algorithms, c.Algorithm) {
+		errs = append(errs, configError{"algorithm", fmt.Sprintf("must be one of %s, got %q", strings.Join(algorithms, ", "), c.Algorithm)})
+	}
+
+	if c.StepSize < 1 || c.StepSize > 10 {
+		errs = append(errs, configError{"step_size", fmt.Sprintf("must be within 1 - 10, got %v", c.StepSize)})
+	}
+
+	// Below 6 elements, the SNR and packet-loss statistics are too noisy to
+	// base a TxPower increase or NbTrans change on. The network server keeps
+	// at most 20 elements, a higher count would never be reached.
+	if c.RequiredHistoryCount < 6 || c.RequiredHistoryCount > 20 {
+		errs = append(errs, configError{"required_history_count", fmt.Sprintf("must be within 6 - 20, got %d", c.RequiredHistoryCount)})
+	}
+
+	if c.QuickStartMinFrames < 0 {
+		errs = append(errs, configError{"quick_start_min_frames", fmt.Sprintf("must be >= 0, got %d", c.QuickStartMinFrames)})
+	}
+
+	for i, threshold := range c.PktLossThresholds {
+		if threshold < 0 || threshold > 100 {
+			errs = append(errs, configError{"pkt_loss_thresholds", fmt.Sprintf("must be within 0 - 100, got %v", c.PktLossThresholds)})
+			break
+		}
+		if i > 0 && threshold <= c.PktLossThresholds[i-1] {
+			errs = append(errs, configError{"pkt_loss_thresholds", fmt.Sprintf("must be strictly increasing, got %v", c.PktLossThresholds)})
+			break
+		}
+	}
+
+	for i, row := range c.PktLossRateTable {
+		for j, nbTrans := range row {
+			if nbTrans < 1 || nbTrans > 15 {
+				errs = append(errs, configError{"pkt_loss_rate_table", fmt.Sprintf("NbTrans must be within 1 - 15, got %d at row %d, column %d", nbTrans, i+1, j+1)})
+			}
+		}
+	}
+
+	if c.PktLossEMAAlpha <= 0 || c.PktLossEMAAlpha > 1 {
+		errs = append(errs, configError{"pkt_loss_ema_alpha", fmt.Sprintf("must be within (0 - 1], got %v", c.PktLossEMAAlpha)})
+	}
+
+	if c.PktLossMaxGap < 0 {
+		errs = append(errs, configError{"pkt_loss_max_gap", fmt.Sprintf("must be >= 0, got %d", c.PktLossMaxGap)})
+	}
+
+	if c.InstallationMarginMin != nil && c.InstallationMarginMax != nil && *c.InstallationMarginMax < *c.InstallationMarginMin {
+		errs = append(errs, configError{"installation_margin_max", fmt.Sprintf("must be >= installation_margin_min (%v), got %v", *c.InstallationMarginMin, *c.InstallationMarginMax)})
+	}
+
+	if _, ok := percentileStrategy(c.SNRStrategy); !ok && !containsString(snrStrategies, c.SNRStrategy) {
+		errs = append(errs, configError{"snr_strategy", fmt.Sprintf("must be one of %s or pNN, got %q", strings.Join(snrStrategies, ", "), c.SNRStrategy)})
+	}
+
+	if c.SNRPercentile < 0 || c.SNRPercentile > 100 {
+		errs = append(errs, configError{"snr_percentile", fmt.Sprintf("must be within 0 - 100, got %v", c.SNRPercentile)})
+	}
+
+	if c.SNREWMAAlpha <= 0 || c.SNREWMAAlpha > 1 {
+		errs = append(errs, configError{"snr_ewma_alpha", fmt.Sprintf("must be within (0 - 1], got %v", c.SNREWMAAlpha)})
+	}
+
+	if c.SNRTrimFraction < 0 || c.SNRTrimFraction >= 0.5 {
+		errs = append(errs, configError{"snr_trim_fraction", fmt.Sprintf("must be within [0 - 0.5), got %v", c.SNRTrimFraction)})
+	}
+
+	if c.SNRRecencyFloor < 0 || c.SNRRecencyFloor > 1 {
+		errs = append(errs, configError{"snr_recency_floor", fmt.Sprintf("must be within 0 - 1, got %v", c.SNRRecencyFloor)})
+	}
+
+	if c.SNRWindow < 0 {
+		errs = append(errs, configError{"snr_window", fmt.Sprintf("must be >= 0, got %d", c.SNRWindow)})
+	}
+
+	if c.SNROutlierSigma < 0 {
+		errs = append(errs, configError{"snr_outlier_sigma", fmt.Sprintf("must be >= 0, got %v", c.SNROutlierSigma)})
+	}
+
+	if !containsString(gatewayWeightings, c.SNRGatewayWeighting) {
+		errs = append(errs, configError{"snr_gateway_weighting", fmt.Sprintf("must be one of %s, got %q", strings.Join(gatewayWeightings, ", "), c.SNRGatewayWeighting)})
+	}
+
+	if c.SNRGatewaySaturation < 0 {
+		errs = append(errs, configError{"snr_gateway_saturation", fmt.Sprintf("must be >= 0, got %d", c.SNRGatewaySaturation)})
+	}
+
+	for _, devEUI := range c.ConfirmedDevEUIs {
+		if b, err := hex.DecodeString(devEUI); err != nil || len(b) != 8 {
+			errs = append(errs, configError{"confirmed_dev_euis", fmt.Sprintf("must be 16 hex characters, got %q", devEUI)})
+		}
+	}
+
+	// Like the pkt_loss_rate_table, the limits are 1 - 15: LoRaWAN defines
+	// no NbTrans 0 and validateRequest rejects it as current NbTrans. An
+	// invalid value falls back to its default, which is compared with the
+	// other value.
+	minNbTrans, maxNbTrans := c.MinNbTrans, c.MaxNbTrans
+	if c.MinNbTrans < 1 || c.MinNbTrans > 15 {
+		errs = append(errs, configError{"min_nb_trans", fmt.Sprintf("must be within 1 - 15, got %d", c.MinNbTrans)})
+		minNbTrans = defaultConfig().MinNbTrans
+	}
+	if c.MaxNbTrans < 1 || c.MaxNbTrans > 15 {
+		errs = append(errs, configError{"max_nb_trans", fmt.Sprintf("must be within 1 - 15, got %d", c.MaxNbTrans)})
+		maxNbTrans = defaultConfig().MaxNbTrans
+	}
+
+	// Which of both is wrong is unknown, both fall back to their default.
+	if maxNbTrans < minNbTrans {
+		if minNbTrans == c.MinNbTrans {
+			errs = append(errs, configError{"min_nb_trans", fmt.Sprintf("must be <= max_nb_trans (%d), got %d", maxNbTrans, c.MinNbTrans)})
+		}
+		if maxNbTrans == c.MaxNbTrans {
+			errs = append(errs, configError{"max_nb_trans", fmt.Sprintf("must be >= min_nb_trans (%d), got %d", minNbTrans, c.MaxNbTrans)})
+		}
+	}
+
+	if c.MinTxPowerIndex < 0 || c.MinTxPowerIndex > 15 {
+		errs = append(errs, configError{"min_tx_power_index", fmt.Sprintf("must be within 0 - 15, got %d", c.MinTxPowerIndex)})
+	}
+
+	if c.MinDR < 0 || c.MinDR > 15 {
+		errs = append(errs, configError{"min_dr", fmt.Sprintf("must be within 0 - 15, got %d", c.MinDR)})
+	}
+
+	if c.MaxIterations < 0 {
+		errs = append(errs, configError{"max_iterations", fmt.Sprintf("must be >= 0, got %d", c.MaxIterations)})
+	}
+
+	if c.MaxStepsPerCall < 0 {
+		errs = append(errs, configError{"max_steps_per_call", fmt.Sprintf("must be >= 0, got %d", c.MaxStepsPerCall)})
+	}
+
+	if c.MaxDownSteps < 0 {
+		errs = append(errs, configError{"max_down_steps", fmt.Sprintf("must be >= 0, got %d", c.MaxDownSteps)})
+	}
+
+	if !containsString(modes, c.Mode) {
+		errs = append(errs, configError{"mode", fmt.Sprintf("must be one of %s, got %q", strings.Join(modes, ", "), c.Mode)})
+	}
+
+	if c.DRIncreaseThreshold < 1 {
+		errs = append(errs, configError{"dr_increase_threshold", fmt.Sprintf("must be at least 1, got %d", c.DRIncreaseThreshold)})
+	}
+
+	if c.MinGatewayCount < 0 {
+		errs = append(errs, configError{"min_gateway_count", fmt.Sprintf("must not be negative, got %d", c.MinGatewayCount)})
+	}
+
+	if c.SingleGatewayMargin < 0 {
+		errs = append(errs, configError{"single_gateway_margin", fmt.Sprintf("must not be negative, got %v", c.SingleGatewayMargin)})
+	}
+
+	if c.HysteresisDB < 0 {
+		errs = append(errs, configError{"hysteresis_db", fmt.Sprintf("must not be negative, got %v", c.HysteresisDB)})
+	}
+
+	if c.CooldownFrames < 0 {
+		errs = append(errs, configError{"cooldown_frames", fmt.Sprintf("must be >= 0, got %d", c.CooldownFrames)})
+	}
+
+	if c.HysteresisUpDB != nil && *c.HysteresisUpDB < 0 {
+		errs = append(errs, configError{"hysteresis_up_db", fmt.Sprintf("must not be negative, got %v", *c.HysteresisUpDB)})
+	}
+
+	if c.HysteresisDownDB != nil && *c.HysteresisDownDB < 0 {
+		errs = append(errs, configError{"hysteresis_down_db", fmt.Sprintf("must not be negative, got %v", *c.HysteresisDownDB)})
+	}
+
+	if c.PlausibleSNRMin != nil && c.PlausibleSNRMax != nil && *c.PlausibleSNRMax < *c.PlausibleSNRMin {
+		errs = append(errs, configError{"plausible_snr_max", fmt.Sprintf("must be >= plausible_snr_min (%v), got %v", *c.PlausibleSNRMin, *c.PlausibleSNRMax)})
+	}
+
+	if c.PlausibleGatewayCountMin < 0 {
+		errs = append(errs, configError{"plausible_gateway_count_min", fmt.Sprintf("must not be negative, got %d", c.PlausibleGatewayCountMin)})
+	}
+
+	for dr := range c.RequiredSNR {
+		if i, err := strconv.Atoi(dr); err != nil || i < 0 || i > 15 {
+			errs = append(errs, configError{"required_snr", fmt.Sprintf("DR must be within 0 - 15, got %q", dr)})
+		}
+	}
+
+	for dr := range c.DRMargin {
+		if i, err := strconv.Atoi(dr); err != nil || i < 0 || i > 15 {
+			errs = append(errs, configError{"dr_margin", fmt.Sprintf("DR must be within 0 - 15, got %q", dr)})
+		}
+	}
+
+	for region, size := range c.RegionStepSize {
+		if size < 1 || size > 10 {
+			errs = append(errs, configError{"region_step_size", fmt.Sprintf("must be within 1 - 10, got %v for %s", size, region)})
+		}
+	}
+
+	return errs
+}
+
+// percentileStrategy returns the percentile of a pNN SNR strategy, e.g. 90
+// for p90.
+func percentileStrategy(s string) (float64, bool) {
+	if len(s) < 2 || s[0] != 'p' {
+		return 0, false
+	}
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+	}
+
+	p, err := strconv.Atoi(s[1:])
+	if err != nil || p > 100 {
+		return 0, false
+	}
+	return float64(p), true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitize resets invalid values to their defaults and warns about
+// incomplete values.
+func (c *Config) sanitize() {
+	for _, err := range c.validate() {
+		def := c.reset(err.key)
+		log.WithError(err).Warnf("Invalid %s, falling back to %v", err.key, fmtField(def))
+	}
+
+	if len(c.RequiredSNR) != 0 {
+		for dr := 0; dr <= 15; dr++ {
+			if _, ok := c.RequiredSNR[strconv.Itoa(dr)]; !ok {
+				log.WithField("dr", dr).Warn("DR is missing in required_snr, using the network-server required SNR")
+			}
+		}
+	}
+}
+
+// reset resets the value of the given key to its default and returns the
+// default value.
+func (c *Config) reset(key string) interface{} {
+	def := reflect.ValueOf(defaultConfig())
+	v := reflect.ValueOf(c).Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("toml") == key {
+			v.Field(i).Set(def.Field(i))
+			return def.Field(i).Interface()
+		}
+	}
+
+	return nil
+}
+
+// validateFile validates the given configuration file and returns all
+// problems. In contrast to loadConfig, the file must exist and the
+// environment is not applied.
+func validateFile(path string) []error {
+	if _, err := os.Stat(path); err != nil {
+		return []error{err}
+	}
+
+	conf := defaultConfig()
+	if err := conf.loadFile(path); err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	for _, err := range conf.validate() {
+		errs = append(errs, err)
+	}
+
+	if conf.PktLossRateTableFile != "" {
+		if _, err := readPktLossRateTable(conf.PktLossRateTableFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestFile writes the given content to a file with the given name in a
+// temporary directory and returns its path.
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setEnv sets the given environment variable until the end of the test.
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Unsetenv(key)
+	})
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(config, defaultConfig()) {
+		t.Errorf("expected the default configuration, got %+v", config)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeTestFile(t, "alitecs-adr.toml", `
+required_history_count = 10
+pkt_loss_thresholds = [1, 2, 3]
+`)
+
+	config, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := defaultConfig()
+	expected.RequiredHistoryCount = 10
+	expected.PktLossThresholds = [3]float32{1, 2, 3}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected %+v, got %+v", expected, config)
+	}
+
+	// 10 uplinks with a single lost frame: not enough history for the
+	// defaults, enough for the file, where the packet-loss of about 6% is
+	// above the last threshold.
+	req := testRequest(-4)
+	req.UplinkHistory = testFCntHistory(append(testFCntRange(100, 105), testFCntRange(106, 111)...)...)
+	for i := range req.UplinkHistory {
+		req.UplinkHistory[i].MaxSNR = -4
+	}
+
+	// The lost frame rules out the quick start.
+	defaults := testHandler(nil)
+	resp, err := defaults.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DR != 2 || resp.TxPowerIndex != 3 || resp.NbTrans != 1 {
+		t.Errorf("expected no change with the defaults, got %+v", resp)
+	}
+
+	h := &Handler{config: config}
+	resp, err = h.Handle(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DR != 4 || resp.TxPowerIndex != 3 || resp.NbTrans != 3 {
+		t.Errorf("expected DR 4, TxPowerIndex 3 and NbTrans 3, got %+v", resp)
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	path := writeTestFile(t, "alitecs-adr.toml", "requried_history_count = 10\n")
+
+	_, err := loadConfig(path, nil)
+	if err == nil || !strings.Contains(err.Error(), "requried_history_count") {
+		t.Errorf("expected an unknown key error, got %v", err)
+	}
+}
+
+func TestLoadConfigHistoryCount(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"6", 6},
+		{"10", 10},
+		{"20", 20},
+		{"0", 20},
+		{"5", 20},
+		{"21", 20},
+		{"100", 20},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.value, func(t *testing.T) {
+			setEnv(t, envPrefix+"HISTORY_COUNT", tst.value)
+
+			config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.RequiredHistoryCount != tst.expected {
+				t.Errorf("expected %d, got %d", tst.expected, config.RequiredHistoryCount)
+			}
+		})
+	}
+
+	t.Run("abc", func(t *testing.T) {
+		setEnv(t, envPrefix+"HISTORY_COUNT", "abc")
+
+		if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestLoadConfigInstallationMarginOverride(t *testing.T) {
+	files := map[string]string{
+		"alitecs-adr.toml": "installation_margin_override = 4.5\n",
+		"alitecs-adr.json": `{"installation_margin_override": 4.5}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			config, err := loadConfig(writeTestFile(t, name, content), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.InstallationMarginOverride == nil || *config.InstallationMarginOverride != 4.5 {
+				t.Errorf("expected installation margin override 4.5, got %v", fmtField(config.InstallationMarginOverride))
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeTestFile(t, "alitecs-adr.toml", "step_size = 4\nhysteresis_db = 1\n")
+
+	config, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StepSize != 4 || config.HysteresisDB != 1 {
+		t.Errorf("expected the file values, got step_size %v and hysteresis_db %v", config.StepSize, config.HysteresisDB)
+	}
+
+	setEnv(t, envPrefix+"STEP_SIZE", "5")
+	setEnv(t, envPrefix+"HYSTERESIS_DB", "2")
+	config, err = loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StepSize != 5 || config.HysteresisDB != 2 {
+		t.Errorf("expected the environment values, got step_size %v and hysteresis_db %v", config.StepSize, config.HysteresisDB)
+	}
+
+	config, err = loadConfig(path, map[string]string{"STEP_SIZE": "6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StepSize != 6 || config.HysteresisDB != 2 {
+		t.Errorf("expected the flag value, got step_size %v and hysteresis_db %v", config.StepSize, config.HysteresisDB)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	setEnv(t, envPrefix+"PKT_LOSS_THRESHOLDS", "1, 2, 3")
+	setEnv(t, envPrefix+"PKT_LOSS_RATE_TABLE", "1,1,1;1,1,2;1,2,2;2,2,2")
+	setEnv(t, envPrefix+"REQUIRED_SNR", "0:-20,1:-17.5")
+	setEnv(t, envPrefix+"DRY_RUN", "true")
+
+	config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := defaultConfig()
+	expected.PktLossThresholds = [3]float32{1, 2, 3}
+	expected.PktLossRateTable = [4][3]int{{1, 1, 1}, {1, 1, 2}, {1, 2, 2}, {2, 2, 2}}
+	expected.RequiredSNR = map[string]float32{"0": -20, "1": -17.5}
+	expected.DryRun = true
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected %+v, got %+v", expected, config)
+	}
+}
+
+func TestLoadConfigInvalidValue(t *testing.T) {
+	t.Run("environment", func(t *testing.T) {
+		setEnv(t, envPrefix+"STEP_SIZE", "abc")
+
+		_, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+		if err == nil || !strings.Contains(err.Error(), envPrefix+"STEP_SIZE") {
+			t.Errorf("expected a %sSTEP_SIZE error, got %v", envPrefix, err)
+		}
+	})
+
+	t.Run("flag", func(t *testing.T) {
+		_, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), map[string]string{"STEP_SIZE": "abc"})
+		if err == nil || !strings.Contains(err.Error(), "-step-size") {
+			t.Errorf("expected a -step-size error, got %v", err)
+		}
+	})
+
+	t.Run("thresholds", func(t *testing.T) {
+		setEnv(t, envPrefix+"PKT_LOSS_THRESHOLDS", "1,2")
+
+		if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestLoadConfigInvalidInstallationMarginOverride(t *testing.T) {
+	path := writeTestFile(t, "alitecs-adr.toml", "installation_margin_override = 4.5\n")
+	setEnv(t, envPrefix+"INSTALLATION_MARGIN_OVERRIDE", "abc")
+
+	config, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.InstallationMarginOverride != nil {
+		t.Errorf("expected no installation margin override, got %v", *config.InstallationMarginOverride)
+	}
+
+	h := &Handler{config: config}
+	if margin := h.getInstallationMargin(testRequest(-10)); margin != 10 {
+		t.Errorf("expected the installation margin of the request, got %v", margin)
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	old := defaultConfig()
+	config := defaultConfig()
+	config.StepSize = 6
+	margin := float32(4)
+	config.InstallationMarginOverride = &margin
+
+	expected := map[string]interface{}{
+		"step_size":                    "3 -> 6",
+		"installation_margin_override": "none -> 4",
+	}
+	if changed := old.diff(config); !reflect.DeepEqual(map[string]interface{}(changed), expected) {
+		t.Errorf("expected %v, got %v", expected, changed)
+	}
+}
+
+func TestWriteTOMLRoundTrip(t *testing.T) {
+	f := func(v float32) *float32 {
+		return &v
+	}
+
+	custom := defaultConfig()
+	custom.StepSize = 2.5
+	custom.InstallationMarginOverride = f(4)
+	custom.InstallationMarginMin = f(5)
+	custom.InstallationMarginMax = f(15)
+	custom.ConfirmedDevEUIs = []string{"0102030405060708"}
+	custom.HysteresisUpDB = f(5)
+	custom.HysteresisDownDB = f(1)
+	custom.SNRSaturation = f(10)
+	custom.RSSINoiseFloor = f(-117)
+	custom.PlausibleSNRMin = f(-30)
+	custom.PlausibleSNRMax = f(20)
+	custom.RequiredSNR = map[string]float32{"0": -20, "1": -17.5}
+	custom.RegionInstallationMargin = map[string]float32{"US915": 2}
+	custom.DRMargin = map[string]float32{"5": 2}
+	custom.RegionStepSize = map[string]float32{"US915": 2.5}
+
+	tests := map[string]Config{
+		"default": defaultConfig(),
+		"custom":  custom,
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := config.writeTOML(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := loadConfig(writeTestFile(t, "alitecs-adr.toml", buf.String()), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded, config) {
+				t.Fatalf("expected %+v, got %+v", config, loaded)
+			}
+
+			// Same configuration, same behavior.
+			for _, snr := range []float32{-20, -13, -10, -4, 5} {
+				req := testRequest(snr)
+				expected, err := (&Handler{config: config}).Handle(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := (&Handler{config: loaded}).Handle(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != expected {
+					t.Errorf("SNR %v: expected %+v, got %+v", snr, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errors  []string
+	}{
+		{
+			name:    "valid",
+			content: "step_size = 2.5\nrequired_history_count = 10\n",
+		},
+		{
+			name:    "unknown key",
+			content: "stepsize = 2.5\n",
+			errors:  []string{"stepsize"},
+		},
+		{
+			name:    "out of range",
+			content: "step_size = 0\n",
+			errors:  []string{"step_size"},
+		},
+		{
+			name:    "all problems",
+			content: "step_size = 0\npkt_loss_thresholds = [10, 5, 30]\npkt_loss_rate_table = [[1, 1, 2], [1, 2, 3], [2, 3, 3], [3, 3, 16]]\n",
+			errors:  []string{"step_size", "pkt_loss_thresholds", "pkt_loss_rate_table"},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			errs := validateFile(writeTestFile(t, "alitecs-adr.toml", tst.content))
+			if len(errs) != len(tst.errors) {
+				t.Fatalf("expected %d errors, got %v", len(tst.errors), errs)
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tst.errors[i]) {
+					t.Errorf("expected a %s error, got %v", tst.errors[i], err)
+				}
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if errs := validateFile(filepath.Join(t.TempDir(), "missing.toml")); len(errs) != 1 {
+			t.Errorf("expected 1 error, got %v", errs)
+		}
+	})
+}
+
+func TestLoadConfigStepDB(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected float32
+	}{
+		{"alias", map[string]string{"STEP_DB": "1.5"}, 1.5},
+		{"step_size takes precedence", map[string]string{"STEP_DB": "1.5", "STEP_SIZE": "4"}, 4},
+		{"below the min.", map[string]string{"STEP_DB": "0.5"}, 3},
+		{"above the max.", map[string]string{"STEP_DB": "11"}, 3},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			for k, v := range tst.env {
+				setEnv(t, envPrefix+k, v)
+			}
+
+			config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.StepSize != tst.expected {
+				t.Errorf("expected step size %v, got %v", tst.expected, config.StepSize)
+			}
+		})
+	}
+
+	config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), map[string]string{"STEP_DB": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.StepSize != 2 {
+		t.Errorf("expected the -step-db flag to set step size 2, got %v", config.StepSize)
+	}
+}
+
+func TestLoadConfigInvalidPktLossRateTable(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		path := writeTestFile(t, "alitecs-adr.toml", "pkt_loss_rate_table = [[1, 1, 2], [1, 2, 3], [2, 3, 3], [3, 3, 16]]\n")
+
+		_, err := loadConfig(path, nil)
+		if err == nil || !strings.Contains(err.Error(), "pkt_loss_rate_table") {
+			t.Errorf("expected a pkt_loss_rate_table error, got %v", err)
+		}
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		setEnv(t, envPrefix+"PKT_LOSS_RATE_TABLE", "1,1,2;1,2,3;2,3,3;3,3,-1")
+
+		_, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+		if err == nil || !strings.Contains(err.Error(), "pkt_loss_rate_table") {
+			t.Errorf("expected a pkt_loss_rate_table error, got %v", err)
+		}
+	})
+
+	t.Run("NbTrans 0", func(t *testing.T) {
+		setEnv(t, envPrefix+"PKT_LOSS_RATE_TABLE", "0,1,2;1,2,3;2,3,3;3,3,3")
+
+		_, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+		if err == nil || !strings.Contains(err.Error(), "pkt_loss_rate_table") {
+			t.Errorf("expected a pkt_loss_rate_table error, got %v", err)
+		}
+	})
+
+	t.Run("table file with NbTrans 0", func(t *testing.T) {
+		setEnv(t, envPrefix+"PKT_LOSS_RATE_TABLE_FILE", writeTestFile(t, "table.json", "[[0,1,2],[1,2,3],[2,3,3],[3,3,3]]"))
+
+		config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := defaultConfig().PktLossRateTable; config.PktLossRateTable != expected {
+			t.Errorf("expected the pkt_loss_rate_table %v, got %v", expected, config.PktLossRateTable)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		setEnv(t, envPrefix+"PKT_LOSS_RATE_TABLE", "1,1,1;1,1,2;1,2,2;2,2,2")
+
+		config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := [4][3]int{{1, 1, 1}, {1, 1, 2}, {1, 2, 2}, {2, 2, 2}}; config.PktLossRateTable != expected {
+			t.Errorf("expected %v, got %v", expected, config.PktLossRateTable)
+		}
+	})
+}
+
+func TestLoadConfigPktLossThresholds(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected [3]float32
+	}{
+		{"2,4,8", [3]float32{2, 4, 8}},
+		{"0,50,100", [3]float32{0, 50, 100}},
+		{"10,5,30", [3]float32{5, 10, 30}},
+		{"5,5,30", [3]float32{5, 10, 30}},
+		{"-1,10,30", [3]float32{5, 10, 30}},
+		{"5,10,101", [3]float32{5, 10, 30}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.value, func(t *testing.T) {
+			setEnv(t, envPrefix+"PKT_LOSS_THRESHOLDS", tst.value)
+
+			config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.PktLossThresholds != tst.expected {
+				t.Errorf("expected %v, got %v", tst.expected, config.PktLossThresholds)
+			}
+		})
+	}
+}
+
+func TestLoadConfigNbTransLimits(t *testing.T) {
+	tests := []struct {
+		name                     string
+		min, max                 string
+		expectedMin, expectedMax int
+	}{
+		{"in range", "2", "5", 2, 5},
+		{"equal", "2", "2", 2, 2},
+		{"min. 0", "0", "3", 1, 3},
+		{"max. 0", "1", "0", 1, 3},
+		{"max. above 15", "1", "16", 1, 3},
+		{"max. below min.", "3", "2", 1, 3},
+		{"min. above an invalid max.", "5", "16", 1, 3},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			setEnv(t, envPrefix+"MIN_NB_TRANS", tst.min)
+			setEnv(t, envPrefix+"MAX_NB_TRANS", tst.max)
+
+			config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.MinNbTrans != tst.expectedMin || config.MaxNbTrans != tst.expectedMax {
+				t.Errorf("expected %d - %d, got %d - %d", tst.expectedMin, tst.expectedMax, config.MinNbTrans, config.MaxNbTrans)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMinDR(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+	}{
+		{"0", 0},
+		{"2", 2},
+		{"15", 15},
+		{"-1", 0},
+		{"16", 0},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.value, func(t *testing.T) {
+			setEnv(t, envPrefix+"MIN_DR", tst.value)
+
+			config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.MinDR != tst.expected {
+				t.Errorf("expected %d, got %d", tst.expected, config.MinDR)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRegionStepSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected map[string]float32
+	}{
+		{"default", "", map[string]float32{"US915": 2.5, "AU915": 2.5}},
+		{"replaced", "[region_step_size]\nEU868 = 2\n", map[string]float32{"EU868": 2}},
+		{"empty", "[region_step_size]\n", map[string]float32{}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			path := writeTestFile(t, "config.toml", tst.content)
+
+			config, err := loadConfig(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(config.RegionStepSize, tst.expected) {
+				t.Errorf("expected %v, got %v", tst.expected, config.RegionStepSize)
+			}
+
+			// The printed configuration is read back unchanged.
+			var buf bytes.Buffer
+			if err := config.writeTOML(&buf); err != nil {
+				t.Fatal(err)
+			}
+			reloaded, err := loadConfig(writeTestFile(t, "printed.toml", buf.String()), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(reloaded.RegionStepSize, tst.expected) {
+				t.Errorf("expected %v after the round trip, got %v", tst.expected, reloaded.RegionStepSize)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSNREWMAAlpha(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected float32
+	}{
+		{"0.5", 0.5},
+		{"1", 1},
+		{"0", 0.3},
+		{"-0.1", 0.3},
+		{"1.5", 0.3},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.value, func(t *testing.T) {
+			setEnv(t, envPrefix+"SNR_EWMA_ALPHA", tst.value)
+
+			config, err := loadConfig(filepath.Join(t.TempDir(), "missing.toml"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.SNREWMAAlpha != tst.expected {
+				t.Errorf("expected %v, got %v", tst.expected, config.SNREWMAAlpha)
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ module alitecs-rn2483-adr
 go 1.16
 
 require (
-	github.com/brocaar/chirpstack-network-server/v3 v3.14.0
+	github.com/BurntSushi/toml v1.2.1
+	github.com/brocaar/chirpstack-network-server/v3 v3.16.8
 	github.com/hashicorp/go-plugin v1.4.1
+	github.com/prometheus/client_golang v1.14.0
 	github.com/sirupsen/logrus v1.7.0
 )
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startTime is the start time of the plugin, used for the uptime.
+var startTime = time.Now()
+
+// healthStatus is the JSON body of the health check.
+type healthStatus struct {
+	Status  string  `json:"status"`
+	ID      string  `json:"id"`
+	Version string  `json:"version"`
+	Uptime  float64 `json:"uptime_seconds"`
+}
+
+// servingState is set to 1 while plugin.Serve is running, see
+// startHealthServer.
+var servingState int32
+
+// setServing marks whether plugin.Serve is running.
+func setServing(serving bool) {
+	var v int32
+	if serving {
+		v = 1
+	}
+	atomic.StoreInt32(&servingState, v)
+}
+
+// isServing returns true while plugin.Serve is running.
+func isServing() bool {
+	return atomic.LoadInt32(&servingState) == 1
+}
+
+// healthHandler returns 200 while plugin.Serve is running and 503 otherwise,
+// with the status, the plugin ID, the version and the uptime as JSON body.
+func (h *Handler) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _ := h.ID()
+	status := healthStatus{
+		Status:  "ok",
+		ID:      id,
+		Version: version,
+		Uptime:  time.Since(startTime).Seconds(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !isServing() {
+		status.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.WithError(err).Error("Health check error")
+	}
+}
+
+// startHealthServer starts serving the health check of the handler on the
+// given address under /healthz.
+func (h *Handler) startHealthServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthHandler)
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	log.WithField("addr", addr).Info("Starting health server")
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.WithError(err).Error("Health server error")
+		}
+	}()
+}
+
+// serveMarked runs serve and marks the plugin as serving until serve returns
+// or panics. A panic is recovered and returned as error, so that the health
+// server can report it.
+func serveMarked(serve func()) (err error) {
+	setServing(true)
+	defer func() {
+		setServing(false)
+		if r := recover(); r != nil {
+			err = fmt.Errorf("serve panic: %v", r)
+		}
+	}()
+
+	serve()
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeMarked(t *testing.T) {
+	var serving bool
+	if err := serveMarked(func() { serving = isServing() }); err != nil {
+		t.Fatal(err)
+	}
+	if !serving {
+		t.Error("expected the plugin to be serving during serve")
+	}
+	if isServing() {
+		t.Error("expected the plugin not to be serving after serve returned")
+	}
+
+	err := serveMarked(func() { panic("listen error") })
+	if err == nil {
+		t.Fatal("expected the panic to be returned as error")
+	}
+	if isServing() {
+		t.Error("expected the plugin not to be serving after serve panicked")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		serving        bool
+		expectedCode   int
+		expectedStatus string
+	}{
+		{"serving", http.MethodGet, true, http.StatusOK, "ok"},
+		{"not serving", http.MethodGet, false, http.StatusServiceUnavailable, "unavailable"},
+		{"invalid method", http.MethodPost, true, http.StatusMethodNotAllowed, ""},
+	}
+
+	h := testHandler(nil)
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			setServing(tst.serving)
+			defer setServing(false)
+
+			rec := httptest.NewRecorder()
+			h.healthHandler(rec, httptest.NewRequest(tst.method, "/healthz", nil))
+
+			if rec.Code != tst.expectedCode {
+				t.Errorf("expected status code %d, got %d", tst.expectedCode, rec.Code)
+			}
+			if tst.expectedStatus == "" {
+				return
+			}
+
+			var status healthStatus
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tst.expectedStatus {
+				t.Errorf("expected status %q, got %q", tst.expectedStatus, status.Status)
+			}
+			if id, _ := h.ID(); status.ID != id || status.Version != version {
+				t.Errorf("expected ID %s and version %s, got %+v", id, version, status)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+)
+
+// deviceState is the state of a single device, which is kept across
+// requests.
+type deviceState struct {
+	// pktLoss is nil until the packet-loss of the device is calculated, see
+	// Config.PktLossPerDevice.
+	pktLoss *pktLossState
+
+	// cooldown is the number of remaining requests during which the current
+	// values are kept, see Config.CooldownFrames.
+	cooldown int
+}
+
+// pktLossState is the packet-loss state of a single device.
+type pktLossState struct {
+	// fCnt is the frame-counter of the last handled uplink.
+	fCnt uint32
+
+	// gatewayCount is the gateway count of the last handled uplink.
+	gatewayCount int
+
+	// ema is the packet-loss (%) moving average.
+	ema float64
+}
+
+// deviceStore keeps the state per device across requests. The state is kept
+// in memory, it starts empty after a restart of the plugin. Devices are never
+// removed, the store grows with the number of handled devices.
+type deviceStore struct {
+	mu      sync.Mutex
+	devices map[string]deviceState
+}
+
+// update calls fn with the state of the given device, which is the zero
+// value for unseen devices, and stores the modified state. Concurrent updates
+// are serialized.
+func (s *deviceStore) update(devEUI string, fn func(*deviceState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.devices == nil {
+		s.devices = make(map[string]deviceState)
+	}
+
+	state := s.devices[devEUI]
+	fn(&state)
+	s.devices[devEUI] = state
+}